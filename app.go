@@ -1,14 +1,17 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/oschwald/geoip2-golang"
@@ -22,7 +25,18 @@ type ConnectionDetails struct {
 		Method         string            `json:"method"`
 		UserAgent      string            `json:"user_agent"`
 		ForwardedFor   string            `json:"x_forwarded_for"`
-		Headers        map[string]string `json:"headers"`
+		Headers        map[string]string `json:"headers,omitempty"`
+		URL            struct {
+			Scheme       string `json:"scheme"`
+			SchemeSource string `json:"scheme_source"`
+			Authority    string `json:"authority"`
+			Path         string `json:"path"`
+			RawQuery     string `json:"raw_query"`
+			RequestURI   string `json:"request_uri"`
+			AbsoluteURL  string `json:"absolute_url"`
+		} `json:"url"`
+		Referrer ReferrerInfo `json:"referrer"`
+		Origin   OriginInfo   `json:"origin"`
 	} `json:"request"`
 
 	Server struct {
@@ -32,25 +46,60 @@ type ConnectionDetails struct {
 	} `json:"server"`
 
 	IPInfo struct {
-		PublicIP     string  `json:"public_ip"`
-		CountryCode  string  `json:"country_code"`
-		Country      string  `json:"country"`
-		City         string  `json:"city"`
-		Latitude     float64 `json:"latitude"`
-		Longitude    float64 `json:"longitude"`
-		Organization string  `json:"org"`
-		PostalCode   string  `json:"postal_code"`
+		PublicIP string `json:"public_ip"`
+		*GeoInfo
+		ReverseDNS *string `json:"reverse_dns,omitempty"`
+
+		ConnectionTypeGuess string `json:"connection_type_guess,omitempty"`
+
+		LanguageHint *LanguageHint `json:"language_hint,omitempty"`
 	} `json:"ip_info"`
 
-	System struct {
-		OS struct {
-			Platform   string `json:"platform"`
-			Arch       string `json:"architecture"`
-			GoVersion  string `json:"go_version"`
-			CPUNum     int    `json:"cpu_count"`
-			Memory     string `json:"total_memory"`
-		} `json:"os"`
-	} `json:"system"`
+	ProxyDetection ProxyDetection `json:"proxy_detection"`
+
+	ReportFingerprint string `json:"report_fingerprint"`
+
+	System *SystemInfo `json:"system,omitempty"`
+
+	Weather *WeatherInfo `json:"weather,omitempty"`
+
+	Warnings []Warning `json:"warnings,omitempty"`
+}
+
+// Warning explains why an enrichment is missing from the response
+type Warning struct {
+	Enrichment string `json:"enrichment"`
+	Reason     string `json:"reason"`
+}
+
+// warn records that an enrichment was skipped or degraded
+func (d *ConnectionDetails) warn(enrichment, reason string) {
+	d.Warnings = append(d.Warnings, Warning{Enrichment: enrichment, Reason: reason})
+}
+
+// GeoInfo holds the location and network owner of an address. It is embedded
+// as a pointer so the fields disappear from ip_info when geo lookups are skipped.
+type GeoInfo struct {
+	CountryCode  string  `json:"country_code"`
+	Country      string  `json:"country"`
+	City         string  `json:"city"`
+	Latitude     float64 `json:"latitude"`
+	Longitude    float64 `json:"longitude"`
+	Organization string  `json:"org"`
+	ASN          uint    `json:"asn"`
+	PostalCode   string  `json:"postal_code"`
+	TimeZone     string  `json:"time_zone"`
+}
+
+// SystemInfo describes the host the server runs on
+type SystemInfo struct {
+	OS struct {
+		Platform  string `json:"platform"`
+		Arch      string `json:"architecture"`
+		GoVersion string `json:"go_version"`
+		CPUNum    int    `json:"cpu_count"`
+		Memory    string `json:"total_memory"`
+	} `json:"os"`
 }
 
 func getNetworkInterfaces() map[string]string {
@@ -72,45 +121,230 @@ func getNetworkInterfaces() map[string]string {
 	return interfaces
 }
 
+// getPublicIPInfo looks ip up in the City and ASN databases
 func getPublicIPInfo(ip string) ConnectionDetails {
-	details := ConnectionDetails{}
-	details.IPInfo.PublicIP = ip
+	db := openGeoDatabases(true)
+	defer db.Close()
+	return db.lookup(ip)
+}
 
-	// Open GeoIP database
-	db, err := geoip2.Open("GeoLite2-City.mmdb")
-	if err != nil {
+// geoDatabases holds the GeoIP databases open for one or more lookups. The
+// ASN database is optional and only opened when asked for.
+type geoDatabases struct {
+	city *geoip2.Reader
+	asn  *geoip2.Reader
+	// withASN records whether the ASN database was wanted
+	withASN bool
+}
+
+// openGeoDatabases opens the City database, and the ASN database when
+// withASN is set; missing files are reported by lookup
+func openGeoDatabases(withASN bool) *geoDatabases {
+	db := &geoDatabases{withASN: withASN}
+	if !switches.enabled("geo") {
+		return db
+	}
+	var err error
+	if db.city, err = geoip2.Open("GeoLite2-City.mmdb"); err != nil {
 		log.Printf("Could not open GeoIP database: %v", err)
+	}
+	if withASN {
+		// The ASN database is optional, so a missing file is only a warning
+		db.asn, _ = geoip2.Open(getenv("GEOIP_ASN_DB", "GeoLite2-ASN.mmdb"))
+	}
+	return db
+}
+
+func (db *geoDatabases) Close() {
+	if db.city != nil {
+		db.city.Close()
+	}
+	if db.asn != nil {
+		db.asn.Close()
+	}
+}
+
+// lookup resolves ip to its location and, if opened, network. The result
+// carries warnings instead of empty values when a lookup is not possible.
+func (db *geoDatabases) lookup(ip string) ConnectionDetails {
+	details := ConnectionDetails{}
+	details.IPInfo.PublicIP = ip
+	if !switches.enabled("geo") {
+		details.warn("geo", "GeoIP lookups are disabled by the operator")
+		return details
+	}
+	if db.city == nil {
+		details.warn("geo", "GeoIP database unavailable")
 		return details
 	}
-	defer db.Close()
 
 	// Parse IP
 	parsedIP := net.ParseIP(ip)
 	if parsedIP == nil {
+		details.warn("geo", fmt.Sprintf("%q is not an IP address", ip))
 		return details
 	}
 
 	// Lookup IP
-	record, err := db.City(parsedIP)
+	record, err := db.city.City(parsedIP)
 	if err != nil {
 		log.Printf("IP lookup error: %v", err)
+		details.warn("geo", fmt.Sprintf("GeoIP lookup failed: %v", err))
 		return details
 	}
 
 	// Populate IP info
+	details.IPInfo.GeoInfo = &GeoInfo{}
 	details.IPInfo.CountryCode = record.Country.IsoCode
 	details.IPInfo.Country = record.Country.Names["en"]
 	details.IPInfo.City = record.City.Names["en"]
 	details.IPInfo.Latitude = record.Location.Latitude
 	details.IPInfo.Longitude = record.Location.Longitude
 	details.IPInfo.PostalCode = record.Postal.Code
+	details.IPInfo.TimeZone = record.Location.TimeZone
+	if record.Country.IsoCode == "" {
+		details.warn("geo", "address not found in the GeoIP database")
+	}
+
+	// ASN details come from the optional GeoLite2-ASN database
+	if db.withASN {
+		asn, org, err := db.lookupASN(parsedIP)
+		if err != nil {
+			details.warn("asn", err.Error())
+		}
+		details.IPInfo.ASN, details.IPInfo.Organization = asn, org
+	}
 
 	return details
 }
 
+func (db *geoDatabases) lookupASN(ip net.IP) (uint, string, error) {
+	if db.asn == nil {
+		return 0, "", fmt.Errorf("ASN database unavailable")
+	}
+	record, err := db.asn.ASN(ip)
+	if err != nil {
+		log.Printf("ASN lookup error: %v", err)
+		return 0, "", fmt.Errorf("ASN lookup failed: %v", err)
+	}
+	return record.AutonomousSystemNumber, record.AutonomousSystemOrganization, nil
+}
+
+// reverseDNS returns the first PTR name of ip without the trailing dot. An
+// address without a PTR record is not an error.
+func reverseDNS(ip string) (string, error) {
+	if !switches.enabled("rdns") {
+		return "", fmt.Errorf("reverse DNS is disabled by the operator")
+	}
+	timeout := getenvDuration("RDNS_TIMEOUT", 2*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return "", nil
+	case errors.As(err, &dnsErr) && dnsErr.IsTimeout:
+		return "", fmt.Errorf("reverse DNS timed out after %s", timeout)
+	case err != nil:
+		return "", fmt.Errorf("reverse DNS failed: %v", err)
+	case len(names) == 0:
+		return "", nil
+	}
+	return strings.TrimSuffix(names[0], "."), nil
+}
+
+// clientIP returns the originating client address, preferring the first
+// X-Forwarded-For entry over the socket peer address
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// trustedProxyHops is the number of reverse proxies in front of the server
+// that append the address they received from to X-Forwarded-For
+var trustedProxyHops = getenvInt("TRUSTED_PROXY_HOPS", 0)
+
+// peerIP returns the address of the connection's peer
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// trustedClientIP returns the client address for security decisions such as
+// rate limiting: the peer address, or with TRUSTED_PROXY_HOPS=N the entry the
+// outermost of the N trusted proxies appended to X-Forwarded-For. Entries to
+// its left are supplied by the client and never used here.
+func trustedClientIP(r *http.Request) string {
+	if trustedProxyHops == 0 {
+		return peerIP(r)
+	}
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	if len(hops) < trustedProxyHops {
+		return peerIP(r)
+	}
+	return hops[len(hops)-trustedProxyHops]
+}
+
+// trustedGeo returns trustedClientIP and its location, reusing the lookup in
+// details when the report is about the same address. The location is nil when
+// geo lookups were skipped or failed.
+func trustedGeo(r *http.Request, details *ConnectionDetails) (string, *GeoInfo) {
+	ip, geo := trustedClientIP(r), details.IPInfo.GeoInfo
+	if ip != details.IPInfo.PublicIP && geo != nil {
+		geo = getPublicIPInfo(ip).IPInfo.GeoInfo
+	}
+	return ip, geo
+}
+
+// requestScheme infers the scheme the client used and what it was inferred from
+func requestScheme(r *http.Request) (string, string) {
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		return strings.ToLower(strings.TrimSpace(strings.Split(proto, ",")[0])), "x-forwarded-proto"
+	}
+	if r.TLS != nil {
+		return "https", "tls"
+	}
+	return "http", "default"
+}
+
+// ipFamily returns "ipv4" or "ipv6" for a textual address, or "" if it does not parse
+func ipFamily(ip string) string {
+	parsed := net.ParseIP(ip)
+	switch {
+	case parsed == nil:
+		return ""
+	case parsed.To4() != nil:
+		return "ipv4"
+	default:
+		return "ipv6"
+	}
+}
+
 func connectionHandler(w http.ResponseWriter, r *http.Request) {
+	// Size-capped responses use the compact report
+	if r.URL.Query().Has("max-bytes") {
+		smallHandler(w, r)
+		return
+	}
+
 	// Prepare connection details
 	details := ConnectionDetails{}
+	skip := parseSkipOptions(r)
 
 	// Request details
 	details.Request.RemoteAddr = r.RemoteAddr
@@ -119,10 +353,27 @@ func connectionHandler(w http.ResponseWriter, r *http.Request) {
 	details.Request.UserAgent = r.UserAgent()
 	details.Request.ForwardedFor = r.Header.Get("X-Forwarded-For")
 	
+	// URL as it arrived, including the scheme seen by the client
+	scheme, source := requestScheme(r)
+	details.Request.URL.Scheme = scheme
+	details.Request.URL.SchemeSource = source
+	details.Request.URL.Authority = r.Host
+	details.Request.URL.Path = r.URL.EscapedPath()
+	details.Request.URL.RawQuery = r.URL.RawQuery
+	details.Request.URL.RequestURI = r.RequestURI
+	absolute := url.URL{Scheme: scheme, Host: r.Host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+	details.Request.URL.AbsoluteURL = absolute.String()
+
+	// Referrer and origin
+	details.Request.Referrer = inspectReferrer(r)
+	details.Request.Origin = inspectOrigin(r)
+
 	// Headers
-	details.Request.Headers = make(map[string]string)
-	for k, v := range r.Header {
-		details.Request.Headers[k] = strings.Join(v, ";")
+	if !skip.Headers {
+		details.Request.Headers = make(map[string]string)
+		for k, v := range r.Header {
+			details.Request.Headers[k] = strings.Join(v, ";")
+		}
 	}
 
 	// Server details
@@ -142,65 +393,113 @@ func connectionHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// System info
-	details.System.OS.Platform = runtime.GOOS
-	details.System.OS.Arch = runtime.GOARCH
-	details.System.OS.GoVersion = runtime.Version()
-	details.System.OS.CPUNum = runtime.NumCPU()
+	if !skip.System {
+		details.System = &SystemInfo{}
+		details.System.OS.Platform = runtime.GOOS
+		details.System.OS.Arch = runtime.GOARCH
+		details.System.OS.GoVersion = runtime.Version()
+		details.System.OS.CPUNum = runtime.NumCPU()
 
-	// Total memory
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
-	details.System.OS.Memory = humanize.Bytes(m.Sys)
+		// Total memory
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		details.System.OS.Memory = humanize.Bytes(m.Sys)
+	}
 
 	// IP Info
-	ip := r.Header.Get("X-Forwarded-For")
-	if ip == "" {
-		ip = strings.Split(r.RemoteAddr, ":")[0]
+	ip := clientIP(r)
+	details.IPInfo.PublicIP = ip
+	if !skip.Geo {
+		ipDetails := getPublicIPInfo(ip)
+		details.IPInfo.GeoInfo = ipDetails.IPInfo.GeoInfo
+		details.Warnings = append(details.Warnings, ipDetails.Warnings...)
+		details.IPInfo.LanguageHint = languageHint(r, details.IPInfo.GeoInfo)
+	}
+	if !skip.RDNS {
+		if rdns, err := reverseDNS(ip); err != nil {
+			details.warn("rdns", err.Error())
+		} else {
+			details.IPInfo.ReverseDNS = &rdns
+			details.IPInfo.ConnectionTypeGuess = guessConnectionType(rdns)
+		}
 	}
-	ipDetails := getPublicIPInfo(ip)
-	details.IPInfo = ipDetails.IPInfo
-
-	// Determine response type
-	acceptHeader := r.Header.Get("Accept")
-	isJSON := strings.Contains(acceptHeader, "application/json") || 
-			  strings.Contains(r.UserAgent(), "curl")
 
-	if isJSON {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(details)
-		return
+	// Weather is opt-in through WEATHER_ENABLED
+	if weatherEnabled() && !skip.Weather {
+		switch {
+		case !switches.enabled("weather"):
+			details.warn("weather", "weather is disabled by the operator")
+		case details.IPInfo.GeoInfo == nil || (details.IPInfo.Latitude == 0 && details.IPInfo.Longitude == 0):
+			details.warn("weather", "no location to look up weather for")
+		default:
+			weather, err := getWeather(r.Context(), details.IPInfo.GeoInfo)
+			if err != nil {
+				details.warn("weather", err.Error())
+			}
+			details.Weather = weather
+		}
 	}
 
-	// HTML response
-	w.Header().Set("Content-Type", "text/html")
-	htmlTemplate := `
-	<!DOCTYPE html>
-	<html>
-	<head>
-		<title>Connection Details</title>
-		<style>
-			body { font-family: Arial, sans-serif; max-width: 900px; margin: 0 auto; padding: 20px; }
-			pre { background-color: #f4f4f4; padding: 15px; border-radius: 5px; white-space: pre-wrap; word-wrap: break-word; }
-		</style>
-	</head>
-	<body>
-		<h1>Connection Details</h1>
-		<pre>%s</pre>
-	</body>
-	</html>`
-
-	jsonOutput, _ := json.MarshalIndent(details, "", "  ")
-	fmt.Fprintf(w, htmlTemplate, string(jsonOutput))
+	// Proxy heuristics
+	details.ProxyDetection = detectProxy(r, &details)
+	details.ReportFingerprint = reportFingerprint(r, &details)
+	history.observe(r, &details)
+
+	writeResponse(w, r, branding.SiteTitle, details)
 }
 
 func main() {
+	if runSubcommand(os.Args[1:]) {
+		return
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "3100"
 	}
 
+	if keyFile := os.Getenv("SIGNING_KEY_FILE"); keyFile != "" {
+		var err error
+		if signer, err = loadSigningKey(keyFile); err != nil {
+			log.Fatalf("Could not load signing key: %v", err)
+		}
+	}
+
+	limiter, err := newRateLimiter()
+	if err != nil {
+		log.Fatalf("Invalid rate limit configuration: %v", err)
+	}
+	if err := loadReportTopN(); err != nil {
+		log.Fatalf("Invalid report configuration: %v", err)
+	}
+	startReportScheduler()
+	monitors.start()
+	history.persist()
+
 	http.HandleFunc("/", connectionHandler)
+	http.HandleFunc("/small", smallHandler)
+	http.HandleFunc("/egress", egressHandler)
+	http.HandleFunc("/export", exportHandler)
+	http.HandleFunc("/check-smtp", smtpCheckHandler)
+	http.HandleFunc("GET /time", timeHandler)
+	http.HandleFunc("GET /probe", probeHandler)
+	http.HandleFunc("GET /history/me", historyHandler)
+	http.HandleFunc("POST /history/me", historyHandler)
+	http.HandleFunc("DELETE /history/me", historyHandler)
+	http.HandleFunc("/ip", addressHandler)
+	http.HandleFunc("/ipv4", addressHandler)
+	http.HandleFunc("/ipv6", addressHandler)
+	http.HandleFunc("/dualstack", dualStackHandler)
+	http.HandleFunc("GET /lookup/{hostname}", lookupHandler)
+	http.HandleFunc("GET /dns/{name}", dnsHandler)
+	http.Handle("/static/", staticHandler())
+	http.HandleFunc("/.well-known/jwks.json", jwksHandler)
+	http.HandleFunc("GET /admin/switches", switchesHandler)
+	http.HandleFunc("PUT /admin/switches", switchesHandler)
+	http.HandleFunc("GET /admin/audit", auditHandler)
+	http.HandleFunc("GET /admin/report", reportHandler)
+	http.HandleFunc("GET /transfer/{id}", transferHandler)
 	
 	fmt.Printf("Server starting on port %s\n", port)
-	log.Fatal(http.ListenAndServe(":" + port, nil))
+	log.Fatal(http.ListenAndServe(":" + port, withRequestID(withTransferStats(noStore(withMaintenance(withRateLimit(limiter, withErrorEnvelope(http.DefaultServeMux))))))))
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AuditEntry records a single admin action
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	ClientIP  string    `json:"client_ip"`
+	Before    any       `json:"before,omitempty"`
+	After     any       `json:"after,omitempty"`
+}
+
+// auditLog appends entries as JSON lines to a file that is never rewritten
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+var audit = &auditLog{path: getenv("AUDIT_LOG_FILE", "audit.jsonl")}
+
+// record appends an entry for the admin action performed by r
+func (a *auditLog) record(r *http.Request, actor, action string, before, after any) error {
+	entry := AuditEntry{
+		Time:      time.Now().UTC(),
+		RequestID: requestID(r),
+		Actor:     actor,
+		Action:    action,
+		ClientIP:  trustedClientIP(r),
+		Before:    before,
+		After:     after,
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// recent returns up to limit of the newest entries, oldest first
+func (a *auditLog) recent(limit int) ([]json.RawMessage, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return []json.RawMessage{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []json.RawMessage{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		entries = append(entries, json.RawMessage(append([]byte(nil), scanner.Bytes()...)))
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// auditHandler serves GET /admin/audit?limit=N
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidParameter, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+
+	entries, err := audit.recent(limit)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, ErrInternal, fmt.Sprintf("could not read the audit log: %v", err))
+		return
+	}
+	writeResponse(w, r, "Audit Log", map[string]any{"entries": entries})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// benchWorker holds the measurements of one load generating goroutine
+type benchWorker struct {
+	latencies []time.Duration
+	statuses  map[int]int
+	errors    int
+}
+
+// runBench implements the "bench" subcommand, which loads a running instance
+// with JSON requests and prints throughput and latency percentiles
+func runBench(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	target := flags.String("target", "http://localhost:3100/", "URL to request")
+	concurrency := flags.Int("concurrency", 10, "number of concurrent connections")
+	duration := flags.Duration("duration", 30*time.Second, "how long to run")
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if *concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1")
+	}
+
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	fmt.Printf("Benchmarking %s with %d connections for %s\n", *target, *concurrency, *duration)
+	workers := make([]*benchWorker, *concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range workers {
+		workers[i] = &benchWorker{statuses: make(map[int]int)}
+		wg.Add(1)
+		go func(worker *benchWorker) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				worker.request(ctx, client, *target)
+			}
+		}(workers[i])
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// Merge the per-worker results
+	var latencies []time.Duration
+	statuses := make(map[int]int)
+	failed := 0
+	for _, worker := range workers {
+		latencies = append(latencies, worker.latencies...)
+		for status, count := range worker.statuses {
+			statuses[status] += count
+		}
+		failed += worker.errors
+	}
+	slices.Sort(latencies)
+
+	fmt.Printf("\nRequests:  %d in %s (%d errors)\n", len(latencies)+failed, elapsed.Round(time.Millisecond), failed)
+	fmt.Printf("RPS:       %.1f\n", float64(len(latencies))/elapsed.Seconds())
+	if len(latencies) > 0 {
+		fmt.Printf("Latency:   p50 %s  p90 %s  p99 %s  max %s\n",
+			percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99), percentile(latencies, 100))
+	}
+	codes := make([]int, 0, len(statuses))
+	for status := range statuses {
+		codes = append(codes, status)
+	}
+	sort.Ints(codes)
+	for _, status := range codes {
+		fmt.Printf("Status %d: %d\n", status, statuses[status])
+	}
+	return nil
+}
+
+// request performs a single timed request, discarding the body
+func (b *benchWorker) request(ctx context.Context, client *http.Client, target string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		b.errors++
+		return
+	}
+	req.Header.Set("Accept", "application/json")
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		// Requests cut off by the end of the run are not errors
+		if ctx.Err() == nil {
+			b.errors++
+		}
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	b.latencies = append(b.latencies, time.Since(start))
+	b.statuses[resp.StatusCode]++
+}
+
+// percentile returns the p-th percentile of sorted latencies
+func percentile(sorted []time.Duration, p int) time.Duration {
+	index := (len(sorted)*p + 99) / 100
+	return sorted[max(index-1, 0)].Round(time.Microsecond)
+}
+
+// runSubcommand dispatches "connection-details <command>" invocations and
+// reports whether one was handled
+func runSubcommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case "bench":
+		if err := runBench(args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+			os.Exit(2)
+		}
+		return true
+	case "probe":
+		if err := runProbeCommand(args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "probe: %v\n", err)
+			os.Exit(2)
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+// Branding customises the HTML pages for an organization's own deployment
+type Branding struct {
+	SiteTitle   string
+	LogoURL     string
+	FooterText  string
+	AccentColor string
+	ContactURL  string
+}
+
+// cssColorPattern accepts hex colors and plain color names
+var cssColorPattern = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|[a-zA-Z]+)$`)
+
+// branding is read once at startup from the SITE_* environment variables
+var branding = loadBranding()
+
+func loadBranding() Branding {
+	b := Branding{
+		SiteTitle:   getenv("SITE_TITLE", "Connection Details"),
+		LogoURL:     getenv("SITE_LOGO_URL", ""),
+		FooterText:  getenv("SITE_FOOTER", ""),
+		AccentColor: getenv("SITE_ACCENT_COLOR", "#333333"),
+		ContactURL:  getenv("SITE_CONTACT_URL", ""),
+	}
+	if !cssColorPattern.MatchString(b.AccentColor) {
+		log.Printf("Ignoring invalid SITE_ACCENT_COLOR %q", b.AccentColor)
+		b.AccentColor = "#333333"
+	}
+	return b
+}
+
+var pageTemplate = template.Must(template.New("page").Parse(`
+	<!DOCTYPE html>
+	<html>
+	<head>
+		<title>{{if ne .Title .Brand.SiteTitle}}{{.Title}} - {{end}}{{.Brand.SiteTitle}}</title>
+		<style>
+			body { font-family: Arial, sans-serif; max-width: 900px; margin: 0 auto; padding: 20px; }
+			header { display: flex; align-items: center; gap: 12px; border-bottom: 3px solid {{.Brand.AccentColor}}; padding-bottom: 10px; }
+			header img { max-height: 40px; }
+			header a { color: inherit; text-decoration: none; font-weight: bold; }
+			h1 { color: {{.Brand.AccentColor}}; }
+			a { color: {{.Brand.AccentColor}}; }
+			pre { background-color: #f4f4f4; padding: 15px; border-radius: 5px; white-space: pre-wrap; word-wrap: break-word; }
+			table { border-collapse: collapse; width: 100%; }
+			td, th { text-align: left; padding: 8px; border-bottom: 1px solid #ddd; }
+			footer { margin-top: 30px; padding-top: 10px; border-top: 1px solid #ddd; color: #666; font-size: 0.9em; }
+		</style>
+	</head>
+	<body>
+		<header>
+			{{if .Brand.LogoURL}}<img src="{{.Brand.LogoURL}}" alt="">{{end}}
+			<a href="/">{{.Brand.SiteTitle}}</a>
+		</header>
+		<h1>{{.Title}}</h1>
+		{{.Body}}
+		{{if or .Brand.FooterText .Brand.ContactURL}}
+		<footer>
+			{{.Brand.FooterText}}
+			{{if .Brand.ContactURL}}<a href="{{.Brand.ContactURL}}">Contact</a>{{end}}
+		</footer>
+		{{end}}
+	</body>
+	</html>`))
+
+// renderPage writes body inside the branded page layout
+func renderPage(w http.ResponseWriter, title string, body template.HTML) {
+	var buf bytes.Buffer
+	if err := executePage(&buf, title, body); err != nil {
+		log.Printf("Could not render page: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	buf.WriteTo(w)
+}
+
+// executePage renders the branded page layout to out
+func executePage(out io.Writer, title string, body template.HTML) error {
+	return pageTemplate.Execute(out, struct {
+		Title string
+		Brand Branding
+		Body  template.HTML
+	}{title, branding, body})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getenv returns the value of the environment variable key or fallback when unset
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// getenvList splits a comma separated environment variable into its trimmed items
+func getenvList(key, fallback string) []string {
+	var items []string
+	for _, item := range strings.Split(getenv(key, fallback), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// getenvDuration parses a duration environment variable, falling back on bad input
+func getenvDuration(key string, fallback time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || d <= 0 {
+		return fallback
+	}
+	return d
+}
+
+// getenvInt parses a non-negative integer environment variable, falling back on bad input
+func getenvInt(key string, fallback int) int {
+	n, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || n < 0 {
+		return fallback
+	}
+	return n
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// connectionTypePatterns maps reverse DNS tokens to access technologies.
+// VPN, hosting and mobile come first since their names often also contain
+// words like "static" or "broadband". Proxy detection uses the same list.
+var connectionTypePatterns = []struct {
+	kind    string
+	pattern *regexp.Regexp
+}{
+	{"vpn", regexp.MustCompile(`^(vpn\d*|proxy\d*|tor|exit\d*|relay\d*)$`)},
+	{"hosting", regexp.MustCompile(`^(vps\d*|vm\d*|cloud|server\d*|srv\d*|dedi(cated)?|hosting|hosted|compute|instance|kvm|amazonaws|googleusercontent|linodeusercontent)$`)},
+	{"colocation", regexp.MustCompile(`^(colo|colocation|datacenter|datacentre|dc\d*|rack\d*)$`)},
+	{"mobile", regexp.MustCompile(`^(mobile|mob|cell|cellular|lte|[345]g|gprs|umts|hsdpa|wwan|nat64|mobileip)$`)},
+	{"satellite", regexp.MustCompile(`^(sat|satellite|starlink|starlinkisp|vsat)$`)},
+	{"fiber", regexp.MustCompile(`^(ftth|fttb|fttp|fttx|fiber|fibre|gpon|xgspon|fios|glasfaser)$`)},
+	{"cable", regexp.MustCompile(`^(cable|docsis|hfc|hsd\d*|catv|cm\d*|cablemodem|kabel)$`)},
+	{"dsl", regexp.MustCompile(`^(dsl|adsl\d*|vdsl\d*|xdsl|sdsl|fttc|ppp|pppoe|bras\d*|dslam|dip\d*)$`)},
+	{"dialup", regexp.MustCompile(`^(dialup|dial|dialin|isdn)$`)},
+	{"business", regexp.MustCompile(`^(biz|business|corp|enterprise|leased)$`)},
+}
+
+// hostingDomains are hosting provider domains whose names contain a separator
+// and so cannot be matched token by token
+var hostingDomains = []string{"your-server.de"}
+
+// rdnsTokenSeparator splits hostnames into the tokens matched above
+var rdnsTokenSeparator = regexp.MustCompile(`[.\-_]+`)
+
+// guessConnectionType classifies a reverse DNS name by keyword, returning
+// "unknown" when no pattern matches. It is a heuristic for deployments without
+// a commercial connection type database.
+func guessConnectionType(rdns string) string {
+	name := strings.TrimSuffix(strings.ToLower(rdns), ".")
+	for _, domain := range hostingDomains {
+		if strings.HasSuffix(name, "."+domain) {
+			return "hosting"
+		}
+	}
+	tokens := rdnsTokenSeparator.Split(name, -1)
+	for _, candidate := range connectionTypePatterns {
+		for _, token := range tokens {
+			if candidate.pattern.MatchString(token) {
+				return candidate.kind
+			}
+		}
+	}
+	return "unknown"
+}
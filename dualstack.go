@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+)
+
+// AddressReport is the minimal response served by the single-family endpoints
+type AddressReport struct {
+	IP     string `json:"ip"`
+	Family string `json:"family"`
+}
+
+// defaultFormat keeps JSON for scripts that fetch the address with wildcard
+// Accept headers, such as wget and python-requests
+func (AddressReport) defaultFormat() string {
+	return "json"
+}
+
+var dualStackTemplate = template.Must(template.New("dualstack").Parse(`
+		<table id="dualstack" data-ipv4-url="{{.IPv4URL}}" data-ipv6-url="{{.IPv6URL}}" data-page-family="{{.PageFamily}}">
+			<tr><th>IPv4 address</th><td id="ipv4">testing&hellip;</td></tr>
+			<tr><th>IPv4 latency</th><td id="ipv4-latency">&ndash;</td></tr>
+			<tr><th>IPv6 address</th><td id="ipv6">testing&hellip;</td></tr>
+			<tr><th>IPv6 latency</th><td id="ipv6-latency">&ndash;</td></tr>
+			<tr><th>Latency delta (IPv6 &minus; IPv4)</th><td id="delta">&ndash;</td></tr>
+			<tr><th>This page was loaded over</th><td id="page-family">{{.PageFamily}}</td></tr>
+		</table>
+		<p id="diagnosis"></p>
+		<script src="/static/dualstack.js"></script>`))
+
+// addressHandler reports the client address and family. It is registered as
+// /ipv4 and /ipv6 so those paths can be served from A-only and AAAA-only
+// hostnames, and as /ip for the dual-stack hostname.
+func addressHandler(w http.ResponseWriter, r *http.Request) {
+	ip := clientIP(r)
+	// The dual-stack page fetches these endpoints from other hostnames
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	writeResponse(w, r, "Your Address", AddressReport{IP: ip, Family: ipFamily(ip)})
+}
+
+// dualStackHandler serves the page that tests IPv4 and IPv6 reachability. The
+// family of the page request itself is the one the browser picked for the
+// dual-stack hostname, which the script compares with the timed probes.
+func dualStackHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		IPv4URL    string
+		IPv6URL    string
+		PageFamily string
+	}{
+		IPv4URL:    familyURL(getenv("IPV4_HOST", ""), "/ipv4"),
+		IPv6URL:    familyURL(getenv("IPV6_HOST", ""), "/ipv6"),
+		PageFamily: ipFamily(clientIP(r)),
+	}
+	var body bytes.Buffer
+	dualStackTemplate.Execute(&body, data)
+	renderPage(w, "IPv4 / IPv6 Test", template.HTML(body.String()))
+}
+
+// familyURL builds a scheme-relative URL on host, or a same-origin path when
+// no single-family hostname is configured
+func familyURL(host, path string) string {
+	if host == "" {
+		return path
+	}
+	return "//" + host + path
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const stunMagicCookie = 0x2112A442
+
+// EgressProbe is the result of a single outbound probe over one address family
+type EgressProbe struct {
+	Target     string `json:"target"`
+	Protocol   string `json:"protocol"`
+	Family     string `json:"family"`
+	SourceIP   string `json:"source_ip,omitempty"`
+	EgressIP   string `json:"egress_ip,omitempty"`
+	Translated bool   `json:"translated"`
+	Duration   string `json:"duration"`
+	Error      string `json:"error,omitempty"`
+
+	network string
+}
+
+// EgressReport summarises the addresses the server egresses from
+type EgressReport struct {
+	EgressIPs []string      `json:"egress_ips"`
+	Probes    []EgressProbe `json:"probes"`
+}
+
+func egressHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireFeature(w, r, "egress") {
+		return
+	}
+	writeResponse(w, r, "Egress Addresses", runEgressProbes(r.Context()))
+}
+
+// runEgressProbes probes every configured HTTP and STUN target over IPv4 and IPv6
+func runEgressProbes(ctx context.Context) EgressReport {
+	timeout := getenvDuration("EGRESS_TIMEOUT", 5*time.Second)
+	httpTargets := getenvList("EGRESS_HTTP_TARGETS", "https://icanhazip.com")
+	stunTargets := getenvList("EGRESS_STUN_TARGETS", "stun.cloudflare.com:3478")
+
+	var probes []EgressProbe
+	for _, network := range []string{"tcp4", "tcp6"} {
+		for _, target := range httpTargets {
+			probes = append(probes, EgressProbe{Target: target, Protocol: "http", Family: familyName(network), network: network})
+		}
+	}
+	for _, network := range []string{"udp4", "udp6"} {
+		for _, target := range stunTargets {
+			probes = append(probes, EgressProbe{Target: target, Protocol: "stun", Family: familyName(network), network: network})
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := range probes {
+		wg.Add(1)
+		go func(p *EgressProbe) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			start := time.Now()
+			var source, egress net.IP
+			var err error
+			if p.Protocol == "http" {
+				source, egress, err = probeHTTP(ctx, p.network, p.Target)
+			} else {
+				source, egress, err = probeSTUN(ctx, p.network, p.Target)
+			}
+			p.Duration = time.Since(start).Round(time.Millisecond).String()
+			if err != nil {
+				p.Error = err.Error()
+				return
+			}
+			p.SourceIP = source.String()
+			p.EgressIP = egress.String()
+			p.Translated = !source.Equal(egress)
+		}(&probes[i])
+	}
+	wg.Wait()
+
+	report := EgressReport{EgressIPs: []string{}, Probes: probes}
+	seen := make(map[string]bool)
+	for _, p := range probes {
+		if p.EgressIP != "" && !seen[p.EgressIP] {
+			seen[p.EgressIP] = true
+			report.EgressIPs = append(report.EgressIPs, p.EgressIP)
+		}
+	}
+	return report
+}
+
+// familyName maps a network such as "tcp6" to "ipv6"
+func familyName(network string) string {
+	return "ipv" + network[len(network)-1:]
+}
+
+// probeHTTP fetches an IP echo service over the given network and returns the
+// local source address together with the address the service reported
+func probeHTTP(ctx context.Context, network, target string) (net.IP, net.IP, error) {
+	var source net.IP
+	dialer := &net.Dialer{}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, addr)
+				if err == nil {
+					source = conn.LocalAddr().(*net.TCPAddr).IP
+				}
+				return conn, err
+			},
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("User-Agent", "curl/8 (connection-details egress probe)")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return nil, nil, err
+	}
+	egress := net.ParseIP(strings.TrimSpace(string(body)))
+	if egress == nil {
+		return nil, nil, errors.New("response did not contain an IP address")
+	}
+	return source, egress, nil
+}
+
+// probeSTUN sends a STUN binding request (RFC 5389) and returns the local source
+// address together with the mapped address reported by the server
+func probeSTUN(ctx context.Context, network, target string) (net.IP, net.IP, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, target)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	request := make([]byte, 20)
+	binary.BigEndian.PutUint16(request[0:], 0x0001)
+	binary.BigEndian.PutUint32(request[4:], stunMagicCookie)
+	rand.Read(request[8:20])
+	if _, err := conn.Write(request); err != nil {
+		return nil, nil, err
+	}
+
+	response := make([]byte, 1500)
+	n, err := conn.Read(response)
+	if err != nil {
+		return nil, nil, err
+	}
+	egress, err := parseSTUNResponse(response[:n], request[8:20])
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn.LocalAddr().(*net.UDPAddr).IP, egress, nil
+}
+
+// parseSTUNResponse extracts the (XOR-)MAPPED-ADDRESS from a binding success response
+func parseSTUNResponse(msg, txID []byte) (net.IP, error) {
+	if len(msg) < 20 || binary.BigEndian.Uint16(msg[0:]) != 0x0101 {
+		return nil, errors.New("not a STUN binding success response")
+	}
+	if binary.BigEndian.Uint32(msg[4:]) != stunMagicCookie || string(msg[8:20]) != string(txID) {
+		return nil, errors.New("STUN transaction mismatch")
+	}
+
+	var mapped net.IP
+	attrs := msg[20:]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:]))
+		if len(attrs) < 4+attrLen {
+			break
+		}
+		value := attrs[4 : 4+attrLen]
+		switch attrType {
+		case 0x0020: // XOR-MAPPED-ADDRESS
+			if ip := stunAddress(value, msg[4:20]); ip != nil {
+				return ip, nil
+			}
+		case 0x0001: // MAPPED-ADDRESS
+			mapped = stunAddress(value, nil)
+		}
+		// Attributes are padded to a multiple of four bytes, but the padding of
+		// the last one may be missing
+		attrs = attrs[min(4+(attrLen+3)&^3, len(attrs)):]
+	}
+	if mapped == nil {
+		return nil, errors.New("STUN response did not contain a mapped address")
+	}
+	return mapped, nil
+}
+
+// stunAddress decodes an address attribute value, XORing it with key when set
+func stunAddress(value, key []byte) net.IP {
+	if len(value) < 4 {
+		return nil
+	}
+	var size int
+	switch value[1] {
+	case 0x01:
+		size = net.IPv4len
+	case 0x02:
+		size = net.IPv6len
+	default:
+		return nil
+	}
+	if len(value) < 4+size {
+		return nil
+	}
+	ip := make(net.IP, size)
+	copy(ip, value[4:4+size])
+	if key != nil {
+		for i := range ip {
+			ip[i] ^= key[i]
+		}
+	}
+	return ip
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestParseSTUNResponseUnpaddedTrailingAttribute(t *testing.T) {
+	txID := []byte("0123456789ab")
+	msg := make([]byte, 20)
+	binary.BigEndian.PutUint16(msg[0:], 0x0101)
+	binary.BigEndian.PutUint32(msg[4:], stunMagicCookie)
+	copy(msg[8:], txID)
+
+	// MAPPED-ADDRESS 192.0.2.1:3478
+	msg = append(msg, 0x00, 0x01, 0x00, 0x08, 0x00, 0x01, 0x0d, 0x96, 192, 0, 2, 1)
+	// A 5 byte SOFTWARE attribute without its 3 bytes of padding
+	msg = append(msg, 0x80, 0x22, 0x00, 0x05, 'h', 'e', 'l', 'l', 'o')
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)-20))
+
+	ip, err := parseSTUNResponse(msg, txID)
+	if err != nil {
+		t.Fatalf("parseSTUNResponse: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("got %v, want 192.0.2.1", ip)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// ErrorCode identifies a class of error in the error envelope
+type ErrorCode string
+
+const (
+	ErrInvalidParameter ErrorCode = "invalid_parameter"
+	ErrInvalidHostname  ErrorCode = "invalid_hostname"
+	ErrInvalidIP        ErrorCode = "invalid_ip"
+	ErrNotFound         ErrorCode = "not_found"
+	ErrTargetNotAllowed ErrorCode = "target_not_allowed"
+	ErrMethodNotAllowed ErrorCode = "method_not_allowed"
+	ErrRateLimited      ErrorCode = "rate_limited"
+	ErrUpstreamFailed   ErrorCode = "upstream_failed"
+	ErrUnauthorized     ErrorCode = "unauthorized"
+	ErrNotConfigured    ErrorCode = "not_configured"
+	ErrMaintenance      ErrorCode = "maintenance"
+	ErrFeatureDisabled  ErrorCode = "feature_disabled"
+	ErrCrossSite        ErrorCode = "cross_site"
+	ErrCapacity         ErrorCode = "capacity_exceeded"
+	ErrInternal         ErrorCode = "internal_error"
+)
+
+// ErrorEnvelope is the body of every 4xx and 5xx response
+type ErrorEnvelope struct {
+	Error struct {
+		Code      ErrorCode `json:"code"`
+		Message   string    `json:"message"`
+		Status    int       `json:"status"`
+		RequestID string    `json:"request_id"`
+		DocsURL   string    `json:"docs_url"`
+	} `json:"error"`
+}
+
+type requestIDKey struct{}
+
+// requestIDPattern limits client supplied request IDs to safe, short tokens
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// withRequestID tags each request with an ID, reusing a well-formed
+// X-Request-ID from the client or proxy, and echoes it in the response
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			buf := make([]byte, 8)
+			rand.Read(buf)
+			id = hex.EncodeToString(buf)
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the ID assigned by withRequestID
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// formats excludes jose: errors are never signed
+func (ErrorEnvelope) formats() []string {
+	return []string{"json", "html"}
+}
+
+// writeError writes the error envelope as JSON or as an HTML page
+func writeError(w http.ResponseWriter, r *http.Request, status int, code ErrorCode, message string) {
+	var envelope ErrorEnvelope
+	envelope.Error.Code = code
+	envelope.Error.Message = message
+	envelope.Error.Status = status
+	envelope.Error.RequestID = requestID(r)
+	envelope.Error.DocsURL = getenv("ERROR_DOCS_URL", "https://github.com/akdrag/connection-details-go#errors")
+
+	w.Header().Add("Vary", "Accept")
+	chosen, _ := negotiate(r, envelope)
+	chosen.render(w, r, status, fmt.Sprintf("%d %s", status, http.StatusText(status)), envelope)
+}
+
+// statusRecorder captures the status of a handler whose output is discarded
+type statusRecorder struct {
+	header http.Header
+	status int
+}
+
+func (s *statusRecorder) Header() http.Header         { return s.header }
+func (s *statusRecorder) Write(b []byte) (int, error) { return len(b), nil }
+func (s *statusRecorder) WriteHeader(status int)      { s.status = status }
+
+// withErrorEnvelope replaces the plain text 404 and 405 responses of mux with
+// the error envelope
+func withErrorEnvelope(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler, pattern := mux.Handler(r)
+		if pattern != "" {
+			// Serve through the mux so path values are populated
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		recorder := &statusRecorder{header: make(http.Header), status: http.StatusOK}
+		handler.ServeHTTP(recorder, r)
+		switch recorder.status {
+		case http.StatusMethodNotAllowed:
+			w.Header().Set("Allow", recorder.header.Get("Allow"))
+			writeError(w, r, recorder.status, ErrMethodNotAllowed, fmt.Sprintf("method %s is not allowed for %s", r.Method, r.URL.Path))
+		case http.StatusNotFound:
+			writeError(w, r, recorder.status, ErrNotFound, fmt.Sprintf("no endpoint at %s", r.URL.Path))
+		default:
+			// Redirects such as trailing slash cleanups are passed through unchanged
+			handler.ServeHTTP(w, r)
+		}
+	})
+}
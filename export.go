@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// sensitiveHeaders are replaced with a placeholder in exported requests, as
+// are headers whose names match sensitiveParam
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Api-Key", "X-Auth-Token", "X-Csrf-Token", "X-Xsrf-Token"}
+
+// sensitiveParam matches query parameter, form field and header names whose
+// values are redacted
+var sensitiveParam = regexp.MustCompile(`(?i)(token|key|secret|password|passwd|sig|signature|session|auth)`)
+
+const redacted = "[REDACTED]"
+
+// maxExportBody is the largest request body included in an export
+const maxExportBody = 64 << 10
+
+// harNameValue is a HAR header or query string entry
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// exportedRequest is the client's request with sensitive values redacted
+type exportedRequest struct {
+	Method      string
+	URL         string
+	HTTPVersion string
+	Headers     []harNameValue
+	Query       []harNameValue
+	Body        []byte
+	Truncated   bool
+}
+
+// formats limits exports to HAR, the default, and curl
+func (exportedRequest) formats() []string {
+	return []string{"har", "curl"}
+}
+
+func init() {
+	registerRenderer("har", "application/json", implements[exportedRequest], renderHAR)
+	registerRenderer("curl", "text/plain; charset=utf-8", implements[exportedRequest], renderCurl)
+}
+
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, r, "Request Export", captureRequest(r))
+}
+
+// renderHAR writes an exportedRequest as a HAR file download
+func renderHAR(w http.ResponseWriter, r *http.Request, status int, title string, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="request.har"`)
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(harLog(v.(exportedRequest)))
+}
+
+// renderCurl writes an exportedRequest as a curl command
+func renderCurl(w http.ResponseWriter, r *http.Request, status int, title string, v any) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintln(w, curlCommand(v.(exportedRequest)))
+}
+
+// captureRequest copies what the client sent, redacting credentials. Go does
+// not preserve header order, so headers are sorted by name.
+func captureRequest(r *http.Request) exportedRequest {
+	req := exportedRequest{Method: r.Method, HTTPVersion: r.Proto}
+
+	query := r.URL.Query()
+	for _, name := range sortedKeys(query) {
+		for _, value := range query[name] {
+			if sensitiveParam.MatchString(name) {
+				value = redacted
+			}
+			req.Query = append(req.Query, harNameValue{name, value})
+		}
+	}
+
+	scheme, _ := requestScheme(r)
+	exported := url.URL{Scheme: scheme, Host: r.Host, Path: r.URL.Path, RawPath: r.URL.RawPath}
+	if len(req.Query) > 0 {
+		values := url.Values{}
+		for _, param := range req.Query {
+			values.Add(param.Name, param.Value)
+		}
+		exported.RawQuery = values.Encode()
+	}
+	req.URL = exported.String()
+
+	req.Headers = append(req.Headers, harNameValue{"Host", r.Host})
+	for _, name := range sortedKeys(r.Header) {
+		for _, value := range r.Header[name] {
+			if slices.Contains(sensitiveHeaders, name) || sensitiveParam.MatchString(name) {
+				value = redacted
+			}
+			req.Headers = append(req.Headers, harNameValue{name, value})
+		}
+	}
+
+	if r.Body != nil {
+		body, _ := io.ReadAll(io.LimitReader(r.Body, maxExportBody+1))
+		req.Truncated = len(body) > maxExportBody
+		req.Body = body[:min(len(body), maxExportBody)]
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/x-www-form-urlencoded" {
+			req.Body = redactForm(req.Body)
+		}
+	}
+	return req
+}
+
+// redactForm replaces the values of sensitive fields in a urlencoded body,
+// keeping the fields in order
+func redactForm(body []byte) []byte {
+	fields := strings.Split(string(body), "&")
+	for i, field := range fields {
+		rawName, _, _ := strings.Cut(field, "=")
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			name = rawName
+		}
+		if sensitiveParam.MatchString(name) {
+			fields[i] = rawName + "=" + url.QueryEscape(redacted)
+		}
+	}
+	return []byte(strings.Join(fields, "&"))
+}
+
+// sortedKeys returns the keys of a header or query map in order
+func sortedKeys[M ~map[string][]string](m M) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// harLog renders the request as a HAR 1.2 log with a single entry
+func harLog(req exportedRequest) any {
+	request := map[string]any{
+		"method":      req.Method,
+		"url":         req.URL,
+		"httpVersion": req.HTTPVersion,
+		"cookies":     []any{},
+		"headers":     req.Headers,
+		"queryString": append([]harNameValue{}, req.Query...),
+		"headersSize": -1,
+		"bodySize":    len(req.Body),
+	}
+	if len(req.Body) > 0 {
+		postData := map[string]any{"mimeType": headerValue(req.Headers, "Content-Type"), "text": string(req.Body)}
+		if req.Truncated {
+			postData["comment"] = fmt.Sprintf("truncated to %d bytes", maxExportBody)
+		}
+		request["postData"] = postData
+	}
+
+	return map[string]any{
+		"log": map[string]any{
+			"version": "1.2",
+			"creator": map[string]string{"name": "connection-details", "version": "1.0"},
+			"entries": []any{map[string]any{
+				"startedDateTime": time.Now().UTC().Format(time.RFC3339Nano),
+				"time":            0,
+				"request":         request,
+				"response": map[string]any{
+					"status": 0, "statusText": "", "httpVersion": "", "cookies": []any{}, "headers": []any{},
+					"content":     map[string]any{"size": 0, "mimeType": ""},
+					"redirectURL": "", "headersSize": -1, "bodySize": -1,
+					"comment": "exported by the server; only the request is recorded",
+				},
+				"cache":   map[string]any{},
+				"timings": map[string]int{"send": 0, "wait": 0, "receive": 0},
+			}},
+		},
+	}
+}
+
+// headerValue returns the first value of name among headers
+func headerValue(headers []harNameValue, name string) string {
+	for _, header := range headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+	return ""
+}
+
+// curlCommand renders the request as an equivalent curl invocation
+func curlCommand(req exportedRequest) string {
+	var cmd bytes.Buffer
+	cmd.WriteString("curl")
+	switch req.HTTPVersion {
+	case "HTTP/1.0":
+		cmd.WriteString(" --http1.0")
+	case "HTTP/1.1":
+		cmd.WriteString(" --http1.1")
+	case "HTTP/2.0":
+		cmd.WriteString(" --http2")
+	}
+	if req.Method != http.MethodGet || len(req.Body) > 0 {
+		cmd.WriteString(" -X " + shellQuote(req.Method))
+	}
+	for _, header := range req.Headers {
+		// curl derives these from the URL and the body
+		if header.Name == "Host" || header.Name == "Content-Length" {
+			continue
+		}
+		cmd.WriteString(" \\\n  -H " + shellQuote(header.Name+": "+header.Value))
+	}
+	if len(req.Body) > 0 {
+		cmd.WriteString(" \\\n  --data-binary " + shellQuote(string(req.Body)))
+	}
+	cmd.WriteString(" \\\n  " + shellQuote(req.URL))
+	return cmd.String()
+}
+
+// shellQuote wraps s in single quotes for POSIX shells
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// userAgentFamilies maps User-Agent strings to a browser or client family.
+// Order matters: Edge and Opera also claim to be Chrome, and Chrome claims to
+// be Safari.
+var userAgentFamilies = []struct {
+	family  string
+	pattern *regexp.Regexp
+}{
+	{"edge", regexp.MustCompile(`Edg(e|A|iOS)?/`)},
+	{"opera", regexp.MustCompile(`OPR/|Opera`)},
+	{"samsung", regexp.MustCompile(`SamsungBrowser/`)},
+	{"chrome", regexp.MustCompile(`Chrome/|CriOS/|Chromium/`)},
+	{"firefox", regexp.MustCompile(`Firefox/|FxiOS/`)},
+	{"safari", regexp.MustCompile(`Safari/`)},
+	{"curl", regexp.MustCompile(`^curl/`)},
+	{"wget", regexp.MustCompile(`^Wget/`)},
+	{"go", regexp.MustCompile(`^Go-http-client/`)},
+	{"python", regexp.MustCompile(`^python-requests/|^python-urllib|^aiohttp/|^httpx/`)},
+	{"okhttp", regexp.MustCompile(`^okhttp/`)},
+}
+
+// fingerprintKey keys the report fingerprint so it cannot be reversed by
+// hashing candidate addresses. Without FINGERPRINT_SECRET a random key is used
+// and fingerprints change when the server restarts.
+var fingerprintKey = sync.OnceValue(loadFingerprintKey)
+
+func loadFingerprintKey() []byte {
+	if secret := getenv("FINGERPRINT_SECRET", ""); secret != "" {
+		return []byte(secret)
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	log.Printf("FINGERPRINT_SECRET is not set, report fingerprints will change on restart")
+	return key
+}
+
+// userAgentFamily returns the client family of ua without its version, or "other"
+func userAgentFamily(ua string) string {
+	for _, candidate := range userAgentFamilies {
+		if candidate.pattern.MatchString(ua) {
+			return candidate.family
+		}
+	}
+	return "other"
+}
+
+// tlsFingerprintHeader names the header in which the TLS terminating proxy
+// passes its fingerprint of the client hello, such as a JA3 or JA4 hash. The
+// server itself only speaks plain HTTP and never sees the handshake.
+var tlsFingerprintHeader = getenv("TLS_FINGERPRINT_HEADER", "")
+
+// tlsFingerprint returns the proxy's TLS fingerprint of the client, or "" when
+// TLS_FINGERPRINT_HEADER is not set or the proxy sent none
+func tlsFingerprint(r *http.Request) string {
+	if tlsFingerprintHeader == "" {
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get(tlsFingerprintHeader))
+}
+
+// reportFingerprint hashes the normalized network context of a report so two
+// visits can be compared without revealing the fields. The address is the
+// peer address or trusted proxy hop, so X-Forwarded-For cannot borrow another
+// network's fingerprint, and IPv6 addresses are reduced to their /64, since
+// privacy extensions rotate the rest. ASN and country are those of that
+// address, empty when geo lookups were skipped or failed, and the TLS
+// fingerprint is empty when no proxy header supplies it.
+func reportFingerprint(r *http.Request, details *ConnectionDetails) string {
+	ip, geo := trustedGeo(r, details)
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		addr = addr.Unmap()
+		if addr.Is6() {
+			ip = netip.PrefixFrom(addr, 64).Masked().String()
+		} else {
+			ip = addr.String()
+		}
+	}
+	var asn, country string
+	if geo != nil {
+		asn = fmt.Sprint(geo.ASN)
+		country = geo.CountryCode
+	}
+
+	fields := []string{
+		"v1",
+		"ip=" + ip,
+		"asn=" + asn,
+		"country=" + country,
+		"ua=" + userAgentFamily(r.UserAgent()),
+		"tls=" + tlsFingerprint(r),
+	}
+	mac := hmac.New(sha256.New, fingerprintKey())
+	mac.Write([]byte(strings.Join(fields, "\n")))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
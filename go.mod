@@ -3,8 +3,13 @@ module deadskull12/ipinfo
 go 1.23.3
 
 require (
-	github.com/dustin/go-humanize v1.0.1 // indirect
-	github.com/oschwald/geoip2-golang v1.11.0 // indirect
+	github.com/dustin/go-humanize v1.0.1
+	github.com/oschwald/geoip2-golang v1.11.0
+	golang.org/x/net v0.33.0
+	golang.org/x/text v0.21.0
+)
+
+require (
 	github.com/oschwald/maxminddb-golang v1.13.0 // indirect
-	golang.org/x/sys v0.20.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
 )
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HistoryEntry is a run of visits from the same network context
+type HistoryEntry struct {
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Visits    int       `json:"visits"`
+	IP        string    `json:"ip"`
+	ASN       uint      `json:"asn,omitempty"`
+	Country   string    `json:"country,omitempty"`
+	TLS       string    `json:"tls,omitempty"`
+}
+
+// HistoryChange is a difference between two consecutive entries
+type HistoryChange struct {
+	Time  time.Time `json:"time"`
+	Field string    `json:"field"`
+	From  string    `json:"from"`
+	To    string    `json:"to"`
+}
+
+// HistoryReport is the response of /history/me
+type HistoryReport struct {
+	Since   time.Time       `json:"since"`
+	Entries []HistoryEntry  `json:"entries"`
+	Changes []HistoryChange `json:"changes"`
+}
+
+const (
+	historyCookie     = "cd_history"
+	historyHeader     = "X-History-Token"
+	historyMaxEntries = 100
+)
+
+type historySession struct {
+	Created time.Time      `json:"created"`
+	Updated time.Time      `json:"updated"`
+	Entries []HistoryEntry `json:"entries"`
+}
+
+// historyStore keeps the visits of clients that opted in, keyed by a hash of
+// their token. Sessions expire HISTORY_TTL after the last visit, and once
+// HISTORY_MAX_CLIENTS are stored no new ones are opened. Without HISTORY_FILE
+// they only live in memory and are lost on restart.
+type historyStore struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxClients int
+	sessions   map[string]*historySession
+	dirty      bool
+
+	saving sync.Mutex
+	path   string
+}
+
+var history = &historyStore{
+	ttl:        getenvDuration("HISTORY_TTL", 30*24*time.Hour),
+	maxClients: max(getenvInt("HISTORY_MAX_CLIENTS", 10000), 1),
+	sessions:   make(map[string]*historySession),
+	path:       getenv("HISTORY_FILE", ""),
+}
+
+// historyOptIns limits how many sessions one address may open, so a single
+// client cannot fill the store
+var historyOptIns = newFixedRateLimiter(loadHistoryOptInLimit())
+
+func loadHistoryOptInLimit() rateLimit {
+	limit, err := parseRateLimit(getenv("HISTORY_OPT_IN_LIMIT", "5/h"))
+	if err != nil || limit.perSecond == 0 {
+		log.Printf("Ignoring HISTORY_OPT_IN_LIMIT: it must be a limit such as 5/h")
+		limit, _ = parseRateLimit("5/h")
+	}
+	return limit
+}
+
+// historyKey is the store key of token, so a copy of HISTORY_FILE holds no
+// usable tokens
+func historyKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// historyToken returns the opt-in token sent as cookie or header
+func historyToken(r *http.Request) string {
+	if token := r.Header.Get(historyHeader); token != "" {
+		return token
+	}
+	if cookie, err := r.Cookie(historyCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// start opens a session and returns its token, or false when the store is
+// full. Active sessions are never evicted to make room.
+func (h *historyStore) start() (string, bool) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sweep()
+	if len(h.sessions) >= h.maxClients {
+		return "", false
+	}
+	now := time.Now().UTC()
+	h.sessions[historyKey(token)] = &historySession{Created: now, Updated: now}
+	h.dirty = true
+	return token, true
+}
+
+// sweep drops expired sessions; the caller holds mu
+func (h *historyStore) sweep() {
+	for key, s := range h.sessions {
+		if time.Since(s.Updated) > h.ttl {
+			delete(h.sessions, key)
+			h.dirty = true
+		}
+	}
+}
+
+// persist loads the sessions saved in HISTORY_FILE and saves them back every
+// HISTORY_SAVE_INTERVAL while they change
+func (h *historyStore) persist() {
+	if h.path == "" {
+		return
+	}
+	data, err := os.ReadFile(h.path)
+	if err == nil {
+		var sessions map[string]*historySession
+		if err = json.Unmarshal(data, &sessions); err == nil && sessions != nil {
+			h.mu.Lock()
+			h.sessions = sessions
+			h.sweep()
+			h.mu.Unlock()
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Could not load visit history from %s: %v", h.path, err)
+	}
+
+	go func() {
+		for range time.Tick(getenvDuration("HISTORY_SAVE_INTERVAL", time.Minute)) {
+			h.save()
+		}
+	}()
+}
+
+// save replaces HISTORY_FILE with the current sessions if they changed
+func (h *historyStore) save() {
+	if h.path == "" {
+		return
+	}
+	h.saving.Lock()
+	defer h.saving.Unlock()
+
+	h.mu.Lock()
+	if !h.dirty {
+		h.mu.Unlock()
+		return
+	}
+	data, err := json.Marshal(h.sessions)
+	h.dirty = false
+	h.mu.Unlock()
+
+	tmp := h.path + ".tmp"
+	if err == nil {
+		err = os.WriteFile(tmp, data, 0o600)
+	}
+	if err == nil {
+		err = os.Rename(tmp, h.path)
+	}
+	if err != nil {
+		log.Printf("Could not save visit history to %s: %v", h.path, err)
+		h.mu.Lock()
+		h.dirty = true
+		h.mu.Unlock()
+	}
+}
+
+// observe records the visit in details for an opted-in client, extending the
+// last entry when nothing changed
+func (h *historyStore) observe(r *http.Request, details *ConnectionDetails) {
+	token := historyToken(r)
+	if token == "" {
+		return
+	}
+	now := time.Now().UTC()
+	ip, geo := trustedGeo(r, details)
+	entry := HistoryEntry{FirstSeen: now, LastSeen: now, Visits: 1, IP: ip, TLS: tlsFingerprint(r)}
+	if geo != nil {
+		entry.ASN = geo.ASN
+		entry.Country = geo.CountryCode
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.sessions[historyKey(token)]
+	if !ok || time.Since(s.Updated) > h.ttl {
+		return
+	}
+	s.Updated = now
+	h.dirty = true
+	if n := len(s.Entries); n > 0 {
+		last := &s.Entries[n-1]
+		if last.IP == entry.IP && last.ASN == entry.ASN && last.Country == entry.Country && last.TLS == entry.TLS {
+			last.LastSeen = now
+			last.Visits++
+			return
+		}
+	}
+	s.Entries = append(s.Entries, entry)
+	if len(s.Entries) > historyMaxEntries {
+		s.Entries = s.Entries[len(s.Entries)-historyMaxEntries:]
+	}
+}
+
+// report returns the history of token
+func (h *historyStore) report(token string) (HistoryReport, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.sessions[historyKey(token)]
+	if !ok || time.Since(s.Updated) > h.ttl {
+		return HistoryReport{}, false
+	}
+
+	report := HistoryReport{Since: s.Created.UTC(), Entries: append([]HistoryEntry{}, s.Entries...), Changes: []HistoryChange{}}
+	for i := 1; i < len(s.Entries); i++ {
+		prev, cur := s.Entries[i-1], s.Entries[i]
+		change := func(field, from, to string) {
+			if from != to {
+				report.Changes = append(report.Changes, HistoryChange{Time: cur.FirstSeen, Field: field, From: from, To: to})
+			}
+		}
+		change("ip", prev.IP, cur.IP)
+		change("asn", fmt.Sprint(prev.ASN), fmt.Sprint(cur.ASN))
+		change("country", prev.Country, cur.Country)
+		change("tls", prev.TLS, cur.TLS)
+	}
+	return report, true
+}
+
+// forget deletes the history of token, from HISTORY_FILE too
+func (h *historyStore) forget(token string) {
+	h.mu.Lock()
+	delete(h.sessions, historyKey(token))
+	h.dirty = true
+	h.mu.Unlock()
+	h.save()
+}
+
+// crossSite reports whether a browser sent r on behalf of another site.
+// Sec-Fetch-Site is used when present and Origin otherwise; clients sending
+// neither, such as curl, are not acting for a web page.
+func crossSite(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return false
+	case "":
+		origin := inspectOrigin(r)
+		return origin.Present && !origin.SameOrigin
+	default:
+		return true
+	}
+}
+
+// historyHandler serves /history/me. POST opts in by issuing a token as a
+// cookie (and in the body, for use in the X-History-Token header), GET reports
+// the recorded visits and what changed between them, and DELETE opts out.
+// Other sites cannot opt a visitor in or out.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	token := historyToken(r)
+	if r.Method != http.MethodGet && crossSite(r) {
+		writeError(w, r, http.StatusForbidden, ErrCrossSite, "visit history cannot be changed from another site")
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		if _, ok := history.report(token); !ok {
+			if ok, wait := historyOptIns.allow(rateLimitKey(trustedClientIP(r))); !ok {
+				seconds := int(wait.Seconds()) + 1
+				w.Header().Set("Retry-After", strconv.Itoa(seconds))
+				writeError(w, r, http.StatusTooManyRequests, ErrRateLimited, fmt.Sprintf("too many visit history opt-ins from this address, retry in %d seconds", seconds))
+				return
+			}
+			if token, ok = history.start(); !ok {
+				writeError(w, r, http.StatusServiceUnavailable, ErrCapacity, "the visit history store is full, try again later")
+				return
+			}
+		}
+		scheme, _ := requestScheme(r)
+		http.SetCookie(w, &http.Cookie{
+			Name:     historyCookie,
+			Value:    token,
+			Path:     "/",
+			MaxAge:   int(history.ttl.Seconds()),
+			HttpOnly: true,
+			Secure:   scheme == "https",
+			SameSite: http.SameSiteLaxMode,
+		})
+		writeResponse(w, r, "Visit History", map[string]string{
+			"token":   token,
+			"message": "visits to / with this cookie or the X-History-Token header are now recorded",
+		})
+	case http.MethodDelete:
+		history.forget(token)
+		http.SetCookie(w, &http.Cookie{Name: historyCookie, Path: "/", MaxAge: -1})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		report, ok := history.report(token)
+		if !ok {
+			writeError(w, r, http.StatusNotFound, ErrNotFound, "no visit history for this client; POST /history/me to opt in")
+			return
+		}
+		writeResponse(w, r, "Visit History", report)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// responseSigner signs JSON responses as compact JWS (RFC 7515)
+type responseSigner struct {
+	key crypto.Signer
+	alg string
+	kid string
+	jwk map[string]string
+}
+
+// signer is nil unless SIGNING_KEY_FILE is configured
+var signer *responseSigner
+
+// loadSigningKey reads an Ed25519 or P-256 private key in PEM form
+func loadSigningKey(file string) (*responseSigner, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var key any
+	if block.Type == "EC PRIVATE KEY" {
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := &responseSigner{}
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		s.key = k
+		s.alg = "EdDSA"
+		s.jwk = map[string]string{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"x":   base64.RawURLEncoding.EncodeToString(k.Public().(ed25519.PublicKey)),
+		}
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 ECDSA keys are supported")
+		}
+		s.key = k
+		s.alg = "ES256"
+		s.jwk = map[string]string{
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(k.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(k.Y.FillBytes(make([]byte, 32))),
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+
+	// The key ID is the RFC 7638 thumbprint; json.Marshal sorts the members as required
+	thumbprintInput, _ := json.Marshal(s.jwk)
+	thumbprint := sha256.Sum256(thumbprintInput)
+	s.kid = base64.RawURLEncoding.EncodeToString(thumbprint[:])
+	return s, nil
+}
+
+// sign returns the compact JWS serialization of payload
+func (s *responseSigner) sign(payload []byte) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid, "cty": "json"})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	switch key := s.key.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signingInput))
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signingInput))
+		r, sv, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			return "", err
+		}
+		// JWS uses the fixed-size R || S encoding rather than ASN.1
+		signature = append(r.FillBytes(make([]byte, 32)), sv.FillBytes(make([]byte, 32))...)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// writeSigned writes v as a compact JWS, the "jose" renderer
+func writeSigned(w http.ResponseWriter, r *http.Request, status int, title string, v any) {
+	if signer == nil {
+		writeError(w, r, http.StatusNotImplemented, ErrNotConfigured, "response signing is not configured")
+		return
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, ErrInternal, err.Error())
+		return
+	}
+	token, err := signer.sign(payload)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, ErrInternal, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/jose")
+	w.WriteHeader(status)
+	fmt.Fprint(w, token)
+}
+
+// jwksHandler publishes the verification key at /.well-known/jwks.json
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	if signer == nil {
+		writeError(w, r, http.StatusNotFound, ErrNotConfigured, "response signing is not configured")
+		return
+	}
+	jwk := map[string]string{"use": "sig", "alg": signer.alg, "kid": signer.kid}
+	for k, v := range signer.jwk {
+		jwk[k] = v
+	}
+	body, _ := json.Marshal(map[string][]map[string]string{"keys": {jwk}})
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	serveCacheable(w, r, "jwks.json", body)
+}
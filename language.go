@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+
+	"golang.org/x/text/language"
+)
+
+// LanguageHint compares the regions in Accept-Language with the country the
+// client address is located in
+type LanguageHint struct {
+	AcceptLanguage string   `json:"accept_language"`
+	Regions        []string `json:"regions"`
+	Country        string   `json:"country"`
+	Mismatch       bool     `json:"mismatch"`
+	Hint           string   `json:"hint,omitempty"`
+}
+
+// languageHint returns nil unless the request names at least one explicit
+// country in Accept-Language (e.g. en-US, not just en) and the address was
+// located. Any listed region matching the country counts as a match, since
+// travellers and multilingual users commonly list several.
+func languageHint(r *http.Request, geo *GeoInfo) *LanguageHint {
+	header := r.Header.Get("Accept-Language")
+	if header == "" || geo == nil || geo.CountryCode == "" {
+		return nil
+	}
+	tags, _, err := language.ParseAcceptLanguage(header)
+	if err != nil {
+		return nil
+	}
+
+	hint := &LanguageHint{AcceptLanguage: header, Regions: []string{}, Country: geo.CountryCode}
+	for _, tag := range tags {
+		region, confidence := tag.Region()
+		if confidence != language.Exact || !region.IsCountry() {
+			continue
+		}
+		if code := region.String(); !slices.Contains(hint.Regions, code) {
+			hint.Regions = append(hint.Regions, code)
+		}
+	}
+	if len(hint.Regions) == 0 {
+		return nil
+	}
+
+	if !slices.Contains(hint.Regions, geo.CountryCode) {
+		hint.Mismatch = true
+		hint.Hint = fmt.Sprintf("the browser asks for %s content but the address is located in %s, which is common behind a VPN or proxy", tags[0], geo.CountryCode)
+	}
+	return hint
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/net/idna"
+)
+
+// HostnameForms reports a looked up name in its Unicode and punycode forms
+type HostnameForms struct {
+	Input    string   `json:"input"`
+	Unicode  string   `json:"unicode"`
+	ASCII    string   `json:"ascii"`
+	Warnings []string `json:"homograph_warnings,omitempty"`
+}
+
+// LookupResult is the response of /lookup/{hostname}
+type LookupResult struct {
+	Hostname  HostnameForms   `json:"hostname"`
+	Addresses []LookupAddress `json:"addresses"`
+	Warnings  []Warning       `json:"warnings,omitempty"`
+}
+
+// LookupAddress is a resolved address enriched with its GeoIP location
+type LookupAddress struct {
+	IP          string `json:"ip"`
+	Family      string `json:"family"`
+	CountryCode string `json:"country_code"`
+	Country     string `json:"country"`
+	City        string `json:"city"`
+}
+
+// DNSResult is the response of /dns/{name}
+type DNSResult struct {
+	Name  HostnameForms `json:"name"`
+	A     []string      `json:"a"`
+	AAAA  []string      `json:"aaaa"`
+	CNAME string        `json:"cname,omitempty"`
+	MX    []string      `json:"mx"`
+	NS    []string      `json:"ns"`
+	TXT   []string      `json:"txt"`
+}
+
+// hostnameProfile maps names like the IDNA lookup profile, rejecting empty or
+// overlong labels, but without its strict hostname rules so the underscore
+// labels of names like _dmarc.example.com and _sip._tcp.example.com pass
+var hostnameProfile = idna.New(idna.MapForLookup(), idna.StrictDomainName(false), idna.BidiRule(), idna.VerifyDNSLength(true))
+
+// scriptTables are the scripts considered when checking labels for homographs
+var scriptTables = map[string]*unicode.RangeTable{
+	"Latin":      unicode.Latin,
+	"Cyrillic":   unicode.Cyrillic,
+	"Greek":      unicode.Greek,
+	"Armenian":   unicode.Armenian,
+	"Georgian":   unicode.Georgian,
+	"Cherokee":   unicode.Cherokee,
+	"Arabic":     unicode.Arabic,
+	"Hebrew":     unicode.Hebrew,
+	"Han":        unicode.Han,
+	"Hiragana":   unicode.Hiragana,
+	"Katakana":   unicode.Katakana,
+	"Hangul":     unicode.Hangul,
+	"Thai":       unicode.Thai,
+	"Devanagari": unicode.Devanagari,
+}
+
+// cjkScripts may legitimately be mixed with each other and with Latin
+var cjkScripts = map[string]bool{"Han": true, "Hiragana": true, "Katakana": true, "Hangul": true}
+
+// latinLookalikes are non-Latin letters that render like Latin ones
+const latinLookalikes = "аеорсухіјѕԁӏԛԝһԍոօսνοαιк"
+
+func lookupHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireFeature(w, r, "lookup") {
+		return
+	}
+	forms, err := normalizeHostname(r.PathValue("hostname"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrInvalidHostname, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), getenvDuration("LOOKUP_TIMEOUT", 5*time.Second))
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, forms.ASCII)
+	if err != nil {
+		writeError(w, r, http.StatusBadGateway, ErrUpstreamFailed, fmt.Sprintf("lookup %s failed: %v", forms.ASCII, err))
+		return
+	}
+
+	// Only location fields are reported, so the ASN database is not opened
+	db := openGeoDatabases(false)
+	defer db.Close()
+	result := LookupResult{Hostname: forms, Addresses: []LookupAddress{}}
+	for _, addr := range addrs {
+		ip := addr.IP.String()
+		address := LookupAddress{IP: ip, Family: ipFamily(ip)}
+		ipDetails := db.lookup(ip)
+		if geo := ipDetails.IPInfo.GeoInfo; geo != nil {
+			address.CountryCode = geo.CountryCode
+			address.Country = geo.Country
+			address.City = geo.City
+		}
+		for _, warning := range ipDetails.Warnings {
+			warning.Reason = ip + ": " + warning.Reason
+			result.Warnings = append(result.Warnings, warning)
+		}
+		result.Addresses = append(result.Addresses, address)
+	}
+	writeResponse(w, r, "Lookup "+forms.Unicode, result)
+}
+
+func dnsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireFeature(w, r, "lookup") {
+		return
+	}
+	forms, err := normalizeHostname(r.PathValue("name"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrInvalidHostname, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), getenvDuration("LOOKUP_TIMEOUT", 5*time.Second))
+	defer cancel()
+	resolver := net.DefaultResolver
+	result := DNSResult{Name: forms, A: []string{}, AAAA: []string{}, MX: []string{}, NS: []string{}, TXT: []string{}}
+
+	// Missing record types are expected, so lookup errors only leave the list empty
+	if addrs, err := resolver.LookupIPAddr(ctx, forms.ASCII); err == nil {
+		for _, addr := range addrs {
+			if addr.IP.To4() != nil {
+				result.A = append(result.A, addr.IP.String())
+			} else {
+				result.AAAA = append(result.AAAA, addr.IP.String())
+			}
+		}
+	}
+	if cname, err := resolver.LookupCNAME(ctx, forms.ASCII); err == nil && !strings.EqualFold(strings.TrimSuffix(cname, "."), forms.ASCII) {
+		result.CNAME = cname
+	}
+	if mxs, err := resolver.LookupMX(ctx, forms.ASCII); err == nil {
+		for _, mx := range mxs {
+			result.MX = append(result.MX, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+		}
+	}
+	if nss, err := resolver.LookupNS(ctx, forms.ASCII); err == nil {
+		for _, ns := range nss {
+			result.NS = append(result.NS, ns.Host)
+		}
+	}
+	if txts, err := resolver.LookupTXT(ctx, forms.ASCII); err == nil {
+		result.TXT = append(result.TXT, txts...)
+	}
+	writeResponse(w, r, "DNS "+forms.Unicode, result)
+}
+
+// normalizeHostname converts a Unicode or punycode name into both forms and
+// flags labels that could be used to impersonate another domain
+func normalizeHostname(input string) (HostnameForms, error) {
+	forms := HostnameForms{Input: input}
+	name := strings.TrimSuffix(strings.TrimSpace(input), ".")
+	if name == "" {
+		return forms, fmt.Errorf("empty hostname")
+	}
+
+	ascii, err := hostnameProfile.ToASCII(name)
+	if err != nil {
+		return forms, fmt.Errorf("invalid hostname %q: %v", input, err)
+	}
+	unicodeName, err := hostnameProfile.ToUnicode(ascii)
+	if err != nil {
+		return forms, fmt.Errorf("invalid hostname %q: %v", input, err)
+	}
+	forms.ASCII = ascii
+	forms.Unicode = unicodeName
+
+	for _, label := range strings.Split(unicodeName, ".") {
+		if warning := homographWarning(label); warning != "" {
+			forms.Warnings = append(forms.Warnings, warning)
+		}
+	}
+	return forms, nil
+}
+
+// homographWarning describes why a label looks deceptive, or returns ""
+func homographWarning(label string) string {
+	scripts := make(map[string]bool)
+	lookalikes := 0
+	letters := 0
+	for _, r := range label {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if strings.ContainsRune(latinLookalikes, r) {
+			lookalikes++
+		}
+		for name, table := range scriptTables {
+			if unicode.Is(table, r) {
+				scripts[name] = true
+				break
+			}
+		}
+	}
+
+	var mixed []string
+	for name := range scripts {
+		if !cjkScripts[name] && name != "Latin" {
+			mixed = append(mixed, name)
+		}
+	}
+	sort.Strings(mixed)
+	switch {
+	case scripts["Latin"] && len(mixed) > 0:
+		return fmt.Sprintf("label %q mixes Latin with %s characters", label, strings.Join(mixed, ", "))
+	case len(mixed) > 1:
+		return fmt.Sprintf("label %q mixes %s characters", label, strings.Join(mixed, ", "))
+	case letters > 0 && lookalikes == letters:
+		return fmt.Sprintf("label %q consists only of %s letters that resemble Latin ones", label, mixed[0])
+	}
+	return ""
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestNormalizeHostname(t *testing.T) {
+	tests := []struct {
+		input, ascii string
+	}{
+		{"_dmarc.example.com", "_dmarc.example.com"},
+		{"_sip._tcp.example.com", "_sip._tcp.example.com"},
+		{"Bücher.example.", "xn--bcher-kva.example"},
+	}
+	for _, test := range tests {
+		forms, err := normalizeHostname(test.input)
+		if err != nil {
+			t.Errorf("normalizeHostname(%q): %v", test.input, err)
+			continue
+		}
+		if forms.ASCII != test.ascii {
+			t.Errorf("normalizeHostname(%q).ASCII = %q, want %q", test.input, forms.ASCII, test.ascii)
+		}
+	}
+
+	if _, err := normalizeHostname("a..example.com"); err == nil {
+		t.Errorf("normalizeHostname accepted an empty label")
+	}
+}
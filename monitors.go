@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// monitorExemptions recognizes uptime monitors so they neither consume rate
+// limit budget nor show up in the visit statistics. A User-Agent is trivial to
+// forge, so it only keeps a request out of the statistics; skipping the rate
+// limit requires the address to be in a configured or fetched monitor range.
+type monitorExemptions struct {
+	userAgents []string
+	static     []netip.Prefix
+	sources    []string
+
+	mu      sync.RWMutex
+	fetched []netip.Prefix
+}
+
+var monitors = newMonitorExemptions()
+
+func newMonitorExemptions() *monitorExemptions {
+	m := &monitorExemptions{
+		userAgents: getenvList("MONITOR_USER_AGENTS", "Pingdom.com_bot,UptimeRobot,StatusCake,Site24x7,Better Uptime Bot"),
+		sources:    getenvList("MONITOR_RANGE_URLS", ""),
+	}
+	for _, item := range getenvList("MONITOR_RANGES", "") {
+		prefix, err := parsePrefix(item)
+		if err != nil {
+			log.Printf("Ignoring monitor range %q: %v", item, err)
+			continue
+		}
+		m.static = append(m.static, prefix)
+	}
+	return m
+}
+
+// parsePrefix accepts a CIDR range or a single address
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// start fetches the MONITOR_RANGE_URLS lists now and every MONITOR_RANGE_REFRESH
+func (m *monitorExemptions) start() {
+	if len(m.sources) == 0 {
+		return
+	}
+	m.refresh()
+	go func() {
+		for range time.Tick(getenvDuration("MONITOR_RANGE_REFRESH", 24*time.Hour)) {
+			m.refresh()
+		}
+	}()
+}
+
+// refresh replaces the fetched ranges, keeping the previous list when any
+// source fails so a vendor outage does not drop the exemptions
+func (m *monitorExemptions) refresh() {
+	var prefixes []netip.Prefix
+	for _, source := range m.sources {
+		list, err := fetchRanges(source)
+		if err != nil {
+			log.Printf("Could not fetch monitor ranges from %s: %v", source, err)
+			return
+		}
+		prefixes = append(prefixes, list...)
+	}
+	m.mu.Lock()
+	m.fetched = prefixes
+	m.mu.Unlock()
+}
+
+// fetchRanges reads one address or CIDR per line, as published by Pingdom and
+// UptimeRobot, skipping blank lines and # comments
+func fetchRanges(source string) ([]netip.Prefix, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var prefixes []netip.Prefix
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, 1<<20))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		prefix, err := parsePrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("bad entry %q: %w", line, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, scanner.Err()
+}
+
+// inRange reports whether ip belongs to a known monitor range
+func (m *monitorExemptions) inRange(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range m.static {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, prefix := range m.fetched {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// exemptFromRateLimit is true for requests from monitor ranges. The address
+// is the peer or trusted proxy hop, never a client supplied X-Forwarded-For entry.
+func (m *monitorExemptions) exemptFromRateLimit(r *http.Request) bool {
+	return m.inRange(trustedClientIP(r))
+}
+
+// exemptFromStats is true for requests from monitor ranges or with a monitor User-Agent
+func (m *monitorExemptions) exemptFromStats(r *http.Request) bool {
+	ua := r.UserAgent()
+	for _, monitor := range m.userAgents {
+		if strings.Contains(ua, monitor) {
+			return true
+		}
+	}
+	return m.exemptFromRateLimit(r)
+}
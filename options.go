@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// skipOptions lists the enrichments a request opted out of
+type skipOptions struct {
+	Geo     bool
+	RDNS    bool
+	System  bool
+	Headers bool
+	Weather bool
+}
+
+// parseSkipOptions combines the SKIP_SECTIONS defaults with the request's
+// ?no-geo, ?no-rdns, ?no-system, ?no-headers and ?no-weather flags. A flag may be given a
+// false value (e.g. ?no-geo=0) to re-enable a section skipped by default.
+func parseSkipOptions(r *http.Request) skipOptions {
+	defaults := getenvList("SKIP_SECTIONS", "")
+	query := r.URL.Query()
+	skipped := func(section string) bool {
+		if values, ok := query["no-"+section]; ok {
+			if values[0] == "" {
+				return true
+			}
+			skip, err := strconv.ParseBool(values[0])
+			return err != nil || skip
+		}
+		return slices.Contains(defaults, section)
+	}
+
+	return skipOptions{
+		Geo:     skipped("geo"),
+		RDNS:    skipped("rdns"),
+		System:  skipped("system"),
+		Headers: skipped("headers"),
+		Weather: skipped("weather"),
+	}
+}
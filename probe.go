@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ProbeResult is the outcome of one blackbox probe
+type ProbeResult struct {
+	Module     string      `json:"module"`
+	Target     string      `json:"target"`
+	Success    bool        `json:"success"`
+	Address    string      `json:"address,omitempty"`
+	StatusCode int         `json:"status_code,omitempty"`
+	TLSVersion string      `json:"tls_version,omitempty"`
+	Phases     ProbePhases `json:"phases"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// ProbePhases are the durations of the probe steps in seconds
+type ProbePhases struct {
+	DNS     float64 `json:"dns_seconds"`
+	Connect float64 `json:"connect_seconds,omitempty"`
+	TLS     float64 `json:"tls_seconds,omitempty"`
+	TTFB    float64 `json:"ttfb_seconds,omitempty"`
+	RTT     float64 `json:"rtt_seconds,omitempty"`
+	Total   float64 `json:"total_seconds"`
+}
+
+// probeModules run a probe against target until ctx expires
+var probeModules = map[string]func(ctx context.Context, target string, result *ProbeResult) error{
+	"http": httpProbe,
+	"tcp":  tcpProbe,
+	"icmp": icmpProbe,
+}
+
+// runProbe runs module against target and fills in the total duration
+func runProbe(ctx context.Context, module, target string, timeout time.Duration) ProbeResult {
+	result := ProbeResult{Module: module, Target: target}
+	probe, ok := probeModules[module]
+	if !ok {
+		result.Error = fmt.Sprintf("unknown module %q", module)
+		return result
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	err := probe(ctx, target, &result)
+	result.Phases.Total = time.Since(start).Seconds()
+	if err != nil {
+		result.Error = err.Error()
+	}
+	result.Success = err == nil
+	return result
+}
+
+// httpProbe requests target without following redirects; 2xx and 3xx succeed
+func httpProbe(ctx context.Context, target string, result *ProbeResult) error {
+	var start, dnsStart, connectStart, tlsStart time.Time
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			result.Phases.DNS = time.Since(dnsStart).Seconds()
+		},
+		ConnectStart: func(string, string) { connectStart = time.Now() },
+		ConnectDone: func(_, addr string, err error) {
+			if err == nil {
+				result.Phases.Connect = time.Since(connectStart).Seconds()
+				result.Address = addr
+			}
+		},
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err == nil {
+				result.Phases.TLS = time.Since(tlsStart).Seconds()
+				result.TLSVersion = tls.VersionName(state.Version)
+			}
+		},
+		GotFirstResponseByte: func() {
+			result.Phases.TTFB = time.Since(start).Seconds()
+		},
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "connection-details probe")
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true, Proxy: http.ProxyFromEnvironment},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	start = time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	result.StatusCode = resp.StatusCode
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// tcpProbe resolves and connects to target, a host:port
+func tcpProbe(ctx context.Context, target string, result *ProbeResult) error {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	ip, err := resolveProbeHost(ctx, host, result)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	result.Phases.Connect = time.Since(start).Seconds()
+	result.Address = conn.RemoteAddr().String()
+	return nil
+}
+
+// icmpProbe sends one echo request to target. It uses an unprivileged ICMP
+// socket when the kernel allows it (net.ipv4.ping_group_range) and falls back
+// to a raw socket, which needs CAP_NET_RAW.
+func icmpProbe(ctx context.Context, target string, result *ProbeResult) error {
+	ip, err := resolveProbeHost(ctx, target, result)
+	if err != nil {
+		return err
+	}
+	result.Address = ip.String()
+
+	network, raw, echoType, proto := "udp4", "ip4:icmp", icmp.Type(ipv4.ICMPTypeEcho), 1
+	if ip.Is6() {
+		network, raw, echoType, proto = "udp6", "ip6:ipv6-icmp", ipv6.ICMPTypeEchoRequest, 58
+	}
+	var dst net.Addr = &net.UDPAddr{IP: ip.AsSlice()}
+	conn, err := icmp.ListenPacket(network, "")
+	if err != nil {
+		if conn, err = icmp.ListenPacket(raw, ""); err != nil {
+			return fmt.Errorf("no ICMP socket available: %w", err)
+		}
+		dst = &net.IPAddr{IP: ip.AsSlice()}
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	id, seq := os.Getpid()&0xffff, int(time.Now().UnixNano()&0xffff)
+	message := icmp.Message{Type: echoType, Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("connection-details")}}
+	packet, err := message.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if _, err := conn.WriteTo(packet, dst); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil {
+			continue
+		}
+		// Unprivileged sockets rewrite the ID, so replies are matched on sequence and sender
+		echo, ok := reply.Body.(*icmp.Echo)
+		if !ok || echo.Seq != seq || !sameIP(from, ip) {
+			continue
+		}
+		if reply.Type != ipv4.ICMPTypeEchoReply && reply.Type != ipv6.ICMPTypeEchoReply {
+			continue
+		}
+		result.Phases.RTT = time.Since(start).Seconds()
+		return nil
+	}
+}
+
+// sameIP reports whether the sender of a packet is ip
+func sameIP(from net.Addr, ip netip.Addr) bool {
+	switch addr := from.(type) {
+	case *net.UDPAddr:
+		return addr.IP.Equal(ip.AsSlice())
+	case *net.IPAddr:
+		return addr.IP.Equal(ip.AsSlice())
+	}
+	return false
+}
+
+// resolveProbeHost resolves host, recording the DNS phase
+func resolveProbeHost(ctx context.Context, host string, result *ProbeResult) (netip.Addr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return ip.Unmap(), nil
+	}
+	start := time.Now()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	result.Phases.DNS = time.Since(start).Seconds()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if len(addrs) == 0 {
+		return netip.Addr{}, fmt.Errorf("no addresses for %s", host)
+	}
+	return addrs[0].Unmap(), nil
+}
+
+// probeHost extracts the host a target refers to for the allowlist
+func probeHost(module, target string) (string, error) {
+	switch module {
+	case "http":
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+			return "", fmt.Errorf("target must be an http or https URL")
+		}
+		return u.Hostname(), nil
+	case "tcp":
+		host, _, err := net.SplitHostPort(target)
+		return host, err
+	}
+	return target, nil
+}
+
+// probeAllowed matches host against PROBE_ALLOWED_TARGETS, whose entries are
+// hostnames, wildcards like *.example.com, addresses or CIDR ranges
+func probeAllowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	addr, addrErr := netip.ParseAddr(host)
+	for _, allowed := range getenvList("PROBE_ALLOWED_TARGETS", "") {
+		allowed = strings.ToLower(allowed)
+		if prefix, err := parsePrefix(allowed); err == nil {
+			if addrErr == nil && prefix.Contains(addr.Unmap()) {
+				return true
+			}
+			continue
+		}
+		if matched, _ := path.Match(allowed, host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	registerRenderer("prometheus", "text/plain; version=0.0.4", implements[ProbeResult], renderProbeMetrics)
+}
+
+// probeHandler serves /probe?module=http|tcp|icmp&target=..., restricted to
+// the operator's allowlist, in the negotiated format; format=prometheus gives
+// the exposition format for scraping like the Prometheus blackbox exporter
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	if len(getenvList("PROBE_ALLOWED_TARGETS", "")) == 0 {
+		writeError(w, r, http.StatusNotImplemented, ErrNotConfigured, "no probe targets are allowed on this server")
+		return
+	}
+	if !requireFeature(w, r, "probe") {
+		return
+	}
+
+	query := r.URL.Query()
+	module, target := query.Get("module"), query.Get("target")
+	if _, ok := probeModules[module]; !ok {
+		writeError(w, r, http.StatusBadRequest, ErrInvalidParameter, "module must be http, tcp or icmp")
+		return
+	}
+	host, err := probeHost(module, target)
+	if err != nil || host == "" {
+		writeError(w, r, http.StatusBadRequest, ErrInvalidParameter, fmt.Sprintf("invalid %s target %q", module, target))
+		return
+	}
+	if !probeAllowed(host) {
+		writeError(w, r, http.StatusForbidden, ErrTargetNotAllowed, fmt.Sprintf("%s is not an allowed probe target", host))
+		return
+	}
+
+	timeout := getenvDuration("PROBE_TIMEOUT", 10*time.Second)
+	if requested, err := time.ParseDuration(query.Get("timeout")); err == nil && requested > 0 {
+		timeout = min(requested, timeout)
+	}
+	writeResponse(w, r, "Probe", runProbe(r.Context(), module, target, timeout))
+}
+
+// renderProbeMetrics writes a ProbeResult in the Prometheus text exposition format
+func renderProbeMetrics(w http.ResponseWriter, r *http.Request, status int, title string, v any) {
+	result := v.(ProbeResult)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(status)
+	success := 0
+	if result.Success {
+		success = 1
+	}
+	fmt.Fprintf(w, "# HELP probe_success Whether the probe succeeded\n# TYPE probe_success gauge\nprobe_success %d\n", success)
+	fmt.Fprintf(w, "# HELP probe_duration_seconds Duration of the whole probe\n# TYPE probe_duration_seconds gauge\nprobe_duration_seconds %g\n", result.Phases.Total)
+	fmt.Fprintf(w, "# HELP probe_phase_duration_seconds Duration of each probe phase\n# TYPE probe_phase_duration_seconds gauge\n")
+	phases := []struct {
+		name    string
+		seconds float64
+	}{
+		{"dns", result.Phases.DNS}, {"connect", result.Phases.Connect}, {"tls", result.Phases.TLS},
+		{"ttfb", result.Phases.TTFB}, {"rtt", result.Phases.RTT},
+	}
+	for _, phase := range phases {
+		fmt.Fprintf(w, "probe_phase_duration_seconds{phase=%q} %g\n", phase.name, phase.seconds)
+	}
+	if result.StatusCode != 0 {
+		fmt.Fprintf(w, "# HELP probe_http_status_code HTTP status of the response\n# TYPE probe_http_status_code gauge\nprobe_http_status_code %d\n", result.StatusCode)
+	}
+}
+
+// runProbeCommand implements the "probe" subcommand, which runs one probe
+// from this host and prints the result as JSON. The allowlist only applies to
+// the HTTP endpoint.
+func runProbeCommand(args []string) error {
+	flags := flag.NewFlagSet("probe", flag.ContinueOnError)
+	module := flags.String("module", "http", "probe type: http, tcp or icmp")
+	target := flags.String("target", "", "URL for http, host:port for tcp, host for icmp")
+	timeout := flags.Duration("timeout", 10*time.Second, "probe timeout")
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if *target == "" {
+		return fmt.Errorf("--target is required")
+	}
+
+	result := runProbe(context.Background(), *module, *target, *timeout)
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(result)
+	if !result.Success {
+		os.Exit(1)
+	}
+	return nil
+}
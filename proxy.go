@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ProxyDetection scores how likely it is that the client sits behind a proxy or VPN
+type ProxyDetection struct {
+	Score   int      `json:"score"`
+	Verdict string   `json:"verdict"`
+	Reasons []string `json:"reasons"`
+}
+
+// proxyHeaders are request headers commonly added by forward proxies
+var proxyHeaders = []string{"Forwarded", "X-Real-IP", "Client-IP", "X-Client-IP", "X-Proxy-ID", "Proxy-Connection", "X-BlueCoat-Via"}
+
+// hostingOrganizations are substrings of AS organizations that run datacenters
+// and VPN endpoints rather than eyeball networks
+var hostingOrganizations = []string{
+	"amazon", "google cloud", "google llc", "microsoft", "digitalocean", "linode", "akamai",
+	"ovh", "hetzner", "vultr", "choopa", "contabo", "scaleway", "online s.a.s", "leaseweb",
+	"m247", "datacamp", "cloudflare", "oracle", "alibaba", "tencent", "hostinger", "packethub",
+	"ionos", "psychz", "quadranet", "colocrossing", "servers.com", "hostwinds",
+}
+
+// detectProxy combines header, ASN and reverse DNS signals into a verdict
+func detectProxy(r *http.Request, details *ConnectionDetails) ProxyDetection {
+	result := ProxyDetection{Reasons: []string{}}
+	add := func(points int, reason string) {
+		result.Score += points
+		result.Reasons = append(result.Reasons, reason)
+	}
+
+	if via := r.Header.Get("Via"); via != "" {
+		add(40, fmt.Sprintf("Via header present (%s)", via))
+	}
+	// The TRUSTED_PROXY_HOPS entries appended by the deployment's own proxies
+	// say nothing about the client
+	if forwarded := strings.Join(r.Header.Values("X-Forwarded-For"), ","); forwarded != "" {
+		if hops := len(strings.Split(forwarded, ",")) - trustedProxyHops; hops > 0 {
+			add(20+5*min(hops-1, 4), fmt.Sprintf("X-Forwarded-For lists %d address(es) beyond the trusted proxies", hops))
+		}
+	}
+	for _, header := range proxyHeaders {
+		if r.Header.Get(header) != "" {
+			add(10, fmt.Sprintf("%s header present", header))
+		}
+	}
+
+	// Geo and rDNS signals are only available when those lookups were not skipped
+	if geo := details.IPInfo.GeoInfo; geo != nil && geo.Organization != "" {
+		org := strings.ToLower(geo.Organization)
+		for _, hosting := range hostingOrganizations {
+			if strings.Contains(org, hosting) {
+				add(35, fmt.Sprintf("AS%d (%s) is a hosting/datacenter network", geo.ASN, geo.Organization))
+				break
+			}
+		}
+	}
+
+	if hint := details.IPInfo.LanguageHint; hint != nil && hint.Mismatch {
+		add(10, fmt.Sprintf("Accept-Language regions (%s) do not include the address's country %s", strings.Join(hint.Regions, ", "), hint.Country))
+	}
+
+	// Reverse DNS names share the keyword list of connection_type_guess
+	if rdns := details.IPInfo.ReverseDNS; rdns != nil && *rdns != "" {
+		switch kind := guessConnectionType(*rdns); kind {
+		case "vpn", "hosting", "colocation":
+			add(25, fmt.Sprintf("reverse DNS %s looks like a %s endpoint", *rdns, kind))
+		}
+	}
+
+	result.Score = min(result.Score, 100)
+	switch {
+	case result.Score >= 50:
+		result.Verdict = "likely"
+	case result.Score >= 25:
+		result.Verdict = "possible"
+	default:
+		result.Verdict = "unlikely"
+	}
+	return result
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimit is a token bucket refill rate and capacity; a zero rate means unlimited
+type rateLimit struct {
+	perSecond float64
+	burst     float64
+}
+
+// bucket tracks the remaining tokens of one client address
+type bucket struct {
+	limit  rateLimit
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits requests per client address. The limit for an address is
+// picked once, when its bucket is created, from the ASN and country overrides
+// or the default.
+type rateLimiter struct {
+	mu        sync.Mutex
+	fallback  rateLimit
+	asn       map[uint]rateLimit
+	country   map[string]rateLimit
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// newRateLimiter builds the limiter from RATE_LIMIT and RATE_LIMIT_OVERRIDES,
+// returning nil when neither is set
+func newRateLimiter() (*rateLimiter, error) {
+	spec := getenv("RATE_LIMIT", "")
+	overrides := getenvList("RATE_LIMIT_OVERRIDES", "")
+	if spec == "" && len(overrides) == 0 {
+		return nil, nil
+	}
+
+	limiter := &rateLimiter{
+		asn:       make(map[uint]rateLimit),
+		country:   make(map[string]rateLimit),
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+	if spec != "" {
+		limit, err := parseRateLimit(spec)
+		if err != nil {
+			return nil, fmt.Errorf("RATE_LIMIT: %v", err)
+		}
+		limiter.fallback = limit
+	}
+
+	// Overrides look like AS14061=10/m or CN=30/m
+	for _, override := range overrides {
+		key, value, ok := strings.Cut(override, "=")
+		if !ok {
+			return nil, fmt.Errorf("RATE_LIMIT_OVERRIDES: %q is not KEY=LIMIT", override)
+		}
+		limit, err := parseRateLimit(value)
+		if err != nil {
+			return nil, fmt.Errorf("RATE_LIMIT_OVERRIDES: %q: %v", override, err)
+		}
+		key = strings.ToUpper(strings.TrimSpace(key))
+		if number, found := strings.CutPrefix(key, "AS"); found && number != "" {
+			asn, err := strconv.ParseUint(number, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("RATE_LIMIT_OVERRIDES: invalid ASN %q", key)
+			}
+			limiter.asn[uint(asn)] = limit
+		} else if len(key) == 2 {
+			limiter.country[key] = limit
+		} else {
+			return nil, fmt.Errorf("RATE_LIMIT_OVERRIDES: %q is neither an ASN nor a country code", key)
+		}
+	}
+	return limiter, nil
+}
+
+// newFixedRateLimiter returns a limiter applying limit to every address
+func newFixedRateLimiter(limit rateLimit) *rateLimiter {
+	return &rateLimiter{
+		fallback:  limit,
+		asn:       make(map[uint]rateLimit),
+		country:   make(map[string]rateLimit),
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// parseRateLimit parses "N/s", "N/m" or "N/h"; "0" or "unlimited" disable limiting
+func parseRateLimit(spec string) (rateLimit, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "0" || spec == "unlimited" {
+		return rateLimit{}, nil
+	}
+	count, unit, ok := strings.Cut(spec, "/")
+	n, err := strconv.Atoi(count)
+	if !ok || err != nil || n <= 0 {
+		return rateLimit{}, fmt.Errorf("invalid rate %q, expected e.g. 60/m", spec)
+	}
+	periods := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+	period, ok := periods[unit]
+	if !ok {
+		return rateLimit{}, fmt.Errorf("invalid rate unit %q, expected s, m or h", unit)
+	}
+	return rateLimit{perSecond: float64(n) / period.Seconds(), burst: float64(n)}, nil
+}
+
+// limitFor resolves the limit of ip through the geo pipeline
+func (l *rateLimiter) limitFor(ip string) rateLimit {
+	if len(l.asn) == 0 && len(l.country) == 0 {
+		return l.fallback
+	}
+	geo := getPublicIPInfo(ip).IPInfo.GeoInfo
+	if geo == nil {
+		return l.fallback
+	}
+	if limit, ok := l.asn[geo.ASN]; ok && geo.ASN != 0 {
+		return limit
+	}
+	if limit, ok := l.country[geo.CountryCode]; ok {
+		return limit
+	}
+	return l.fallback
+}
+
+// allow takes a token for ip, returning how long to wait when none is left
+func (l *rateLimiter) allow(ip string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	b, ok := l.buckets[ip]
+	l.mu.Unlock()
+	if !ok {
+		// Resolve outside the lock; a concurrent first request may do the same work
+		limit := l.limitFor(ip)
+		l.mu.Lock()
+		if b, ok = l.buckets[ip]; !ok {
+			b = &bucket{limit: limit, tokens: limit.burst, last: now}
+			l.buckets[ip] = b
+		}
+		l.mu.Unlock()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	if b.limit.perSecond == 0 {
+		return true, 0
+	}
+	b.tokens = math.Min(b.limit.burst, b.tokens+now.Sub(b.last).Seconds()*b.limit.perSecond)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / b.limit.perSecond * float64(time.Second))
+	return false, wait
+}
+
+// sweep drops buckets that have refilled completely; the caller holds l.mu
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for ip, b := range l.buckets {
+		if b.limit.perSecond == 0 || now.Sub(b.last).Seconds()*b.limit.perSecond >= b.limit.burst {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// rateLimitKey is the bucket an address counts against. IPv6 clients share
+// their /64, since a single subscriber usually holds the whole prefix.
+func rateLimitKey(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Unmap().Is6() {
+		return ip
+	}
+	return netip.PrefixFrom(addr, 64).Masked().Addr().String()
+}
+
+// withRateLimit rejects clients that exceed their limit with 429 Too Many Requests
+func withRateLimit(limiter *rateLimiter, next http.Handler) http.Handler {
+	if limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if monitors.exemptFromRateLimit(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok, wait := limiter.allow(rateLimitKey(trustedClientIP(r)))
+		if !ok {
+			seconds := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			writeError(w, r, http.StatusTooManyRequests, ErrRateLimited, fmt.Sprintf("rate limit exceeded, retry in %d seconds", seconds))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
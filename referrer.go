@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ReferrerInfo describes the Referer header and what it reveals about the referrer policy
+type ReferrerInfo struct {
+	Present       bool   `json:"present"`
+	Raw           string `json:"raw,omitempty"`
+	Scheme        string `json:"scheme,omitempty"`
+	Host          string `json:"host,omitempty"`
+	Path          string `json:"path,omitempty"`
+	QueryKept     bool   `json:"query_kept"`
+	Kept          string `json:"kept"`
+	SameOrigin    bool   `json:"same_origin"`
+	ImpliedPolicy string `json:"implied_policy"`
+}
+
+// OriginInfo describes the Origin header as sent by the browser
+type OriginInfo struct {
+	Present    bool   `json:"present"`
+	Raw        string `json:"raw,omitempty"`
+	Scheme     string `json:"scheme,omitempty"`
+	Host       string `json:"host,omitempty"`
+	Opaque     bool   `json:"opaque"`
+	SameOrigin bool   `json:"same_origin"`
+}
+
+// inspectReferrer parses the Referer header and infers the referrer policy that
+// would produce it, comparing against the origin the request was made to
+func inspectReferrer(r *http.Request) ReferrerInfo {
+	info := ReferrerInfo{Kept: "nothing"}
+	scheme, _ := requestScheme(r)
+	raw := r.Header.Get("Referer")
+	if raw == "" {
+		info.ImpliedPolicy = "no-referrer, or a policy that strips the referrer on this navigation (e.g. strict-origin-when-cross-origin on an https to http downgrade)"
+		return info
+	}
+
+	info.Present = true
+	info.Raw = raw
+	ref, err := url.Parse(raw)
+	if err != nil || ref.Host == "" {
+		info.Kept = "unparseable"
+		info.ImpliedPolicy = "unknown"
+		return info
+	}
+	info.Scheme = ref.Scheme
+	info.Host = ref.Host
+	info.Path = ref.EscapedPath()
+	info.QueryKept = ref.RawQuery != ""
+	info.SameOrigin = strings.EqualFold(ref.Scheme, scheme) && strings.EqualFold(ref.Host, r.Host)
+	downgrade := ref.Scheme == "https" && scheme == "http"
+
+	if (info.Path == "" || info.Path == "/") && !info.QueryKept {
+		info.Kept = "origin"
+	} else {
+		info.Kept = "full-url"
+	}
+
+	switch {
+	case info.Kept == "origin" && info.SameOrigin:
+		info.ImpliedPolicy = "origin or strict-origin (same-origin requests keep the full URL under the default policy)"
+	case info.Kept == "origin" && downgrade:
+		info.ImpliedPolicy = "origin (the strict-* policies would have sent nothing on a downgrade)"
+	case info.Kept == "origin":
+		info.ImpliedPolicy = "strict-origin-when-cross-origin (browser default), strict-origin or origin"
+	case info.SameOrigin:
+		info.ImpliedPolicy = "strict-origin-when-cross-origin (browser default) or any policy that keeps the full URL same-origin"
+	case downgrade:
+		info.ImpliedPolicy = "unsafe-url (the full URL was sent on an https to http downgrade)"
+	default:
+		info.ImpliedPolicy = "unsafe-url or no-referrer-when-downgrade (the full URL was sent cross-origin)"
+	}
+	return info
+}
+
+// inspectOrigin parses the Origin header
+func inspectOrigin(r *http.Request) OriginInfo {
+	raw := r.Header.Get("Origin")
+	if raw == "" {
+		return OriginInfo{}
+	}
+
+	info := OriginInfo{Present: true, Raw: raw}
+	// Sandboxed documents, file: URLs and privacy-sensitive redirects send "null"
+	if raw == "null" {
+		info.Opaque = true
+		return info
+	}
+	if origin, err := url.Parse(raw); err == nil {
+		scheme, _ := requestScheme(r)
+		info.Scheme = origin.Scheme
+		info.Host = origin.Host
+		info.SameOrigin = strings.EqualFold(origin.Scheme, scheme) && strings.EqualFold(origin.Host, r.Host)
+	}
+	return info
+}
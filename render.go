@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// renderer writes a handler's report, or an error envelope, in one format.
+// It sends status itself so it can still fail with an error response.
+type renderer struct {
+	format      string
+	contentType string
+	// supports reports whether the renderer can write v; nil means any value
+	supports func(v any) bool
+	render   func(w http.ResponseWriter, r *http.Request, status int, title string, v any)
+}
+
+// renderers are the registered output formats in order of preference when
+// the client accepts several equally
+var renderers []*renderer
+
+// registerRenderer adds an output format. format names it for ?format=,
+// contentType is sent and matched against the Accept header, and supports,
+// if not nil, limits the values it is offered.
+func registerRenderer(format, contentType string, supports func(v any) bool, render func(w http.ResponseWriter, r *http.Request, status int, title string, v any)) {
+	renderers = append(renderers, &renderer{format: format, contentType: contentType, supports: supports, render: render})
+}
+
+func init() {
+	registerRenderer("json", "application/json", nil, renderJSON)
+	registerRenderer("html", "text/html", nil, renderHTML)
+	registerRenderer("jose", "application/jose", nil, writeSigned)
+}
+
+// formatRestricted is implemented by values that can only be written in some
+// of the formats, such as error envelopes, which are never signed
+type formatRestricted interface {
+	formats() []string
+}
+
+// defaultFormatted is implemented by values served to API clients first,
+// which keep their format when the Accept header only has wildcards
+type defaultFormatted interface {
+	defaultFormat() string
+}
+
+// htmlRenderable is implemented by values with their own page body instead
+// of the indented JSON
+type htmlRenderable interface {
+	htmlBody() template.HTML
+}
+
+// implements returns a supports function accepting the values of type T
+func implements[T any](v any) bool {
+	_, ok := v.(T)
+	return ok
+}
+
+// usableRenderers returns the renderers that can write v, in registry order
+func usableRenderers(v any) []*renderer {
+	restricted, isRestricted := v.(formatRestricted)
+	var usable []*renderer
+	for _, candidate := range renderers {
+		if candidate.supports != nil && !candidate.supports(v) {
+			continue
+		}
+		if isRestricted && !slices.Contains(restricted.formats(), candidate.format) {
+			continue
+		}
+		usable = append(usable, candidate)
+	}
+	return usable
+}
+
+// negotiate picks the renderer for v: ?format= (or ?sign for "jose") first,
+// then the content type the Accept header names with the highest quality.
+// Wildcards alone leave the choice to the default: the default format of v if
+// it has one, otherwise JSON for curl and HTML for everything else, or the
+// first format v supports. ok is false when
+// ?format= names a format v cannot be written in.
+func negotiate(r *http.Request, v any) (chosen *renderer, ok bool) {
+	usable := usableRenderers(v)
+	byFormat := func(format string) *renderer {
+		return rendererFor(format, v)
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if chosen := byFormat(format); chosen != nil {
+		return chosen, true
+	}
+	ok = format == ""
+	if query.Has("sign") {
+		// Values that are never signed, such as errors, still go to a machine client as JSON
+		if chosen := cmp.Or(byFormat("jose"), byFormat("json")); chosen != nil {
+			return chosen, ok
+		}
+	}
+
+	bestQuality := 0.0
+	for _, candidate := range usable {
+		if quality := acceptQuality(r.Header.Get("Accept"), candidate.contentType); quality > bestQuality {
+			chosen, bestQuality = candidate, quality
+		}
+	}
+	if chosen != nil {
+		return chosen, ok
+	}
+	if preferred, hasDefault := v.(defaultFormatted); hasDefault {
+		chosen = byFormat(preferred.defaultFormat())
+	}
+	if chosen != nil {
+		return chosen, ok
+	}
+	if strings.Contains(r.UserAgent(), "curl") {
+		chosen = byFormat("json")
+	} else {
+		chosen = byFormat("html")
+	}
+	if chosen == nil && len(usable) > 0 {
+		chosen = usable[0]
+	}
+	return chosen, ok
+}
+
+// rendererFor returns the renderer of format if it can write v
+func rendererFor(format string, v any) *renderer {
+	for _, candidate := range usableRenderers(v) {
+		if candidate.format == format {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// renderFormat renders v in format where there is no client to negotiate
+// with, such as reports delivered to files and webhooks, and returns the body
+// and its content type
+func renderFormat(format, title string, v any) ([]byte, string, error) {
+	chosen := rendererFor(format, v)
+	if chosen == nil {
+		return nil, "", fmt.Errorf("unknown format %q, use %s", format, formatNames(v))
+	}
+	buf := &responseBuffer{header: make(http.Header)}
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept", "application/json")
+	chosen.render(buf, r, http.StatusOK, title, v)
+	if buf.status != http.StatusOK {
+		var envelope ErrorEnvelope
+		json.Unmarshal(buf.body.Bytes(), &envelope)
+		return nil, "", fmt.Errorf("could not render %s: %s", format, envelope.Error.Message)
+	}
+	return buf.body.Bytes(), buf.header.Get("Content-Type"), nil
+}
+
+// formatNames lists the formats v can be written in, for error messages
+func formatNames(v any) string {
+	var names []string
+	for _, candidate := range usableRenderers(v) {
+		names = append(names, candidate.format)
+	}
+	return strings.Join(names, ", ")
+}
+
+// acceptQuality returns the q value the Accept header gives the media type of
+// contentType by name, ignoring wildcard ranges
+func acceptQuality(accept, contentType string) float64 {
+	contentType, _, _ = mime.ParseMediaType(contentType)
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil || mediaType != contentType {
+			continue
+		}
+		quality := 1.0
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			quality = q
+		}
+		return quality
+	}
+	return 0
+}
+
+// writeResponse renders v in the format negotiated with the client
+func writeResponse(w http.ResponseWriter, r *http.Request, title string, v any) {
+	w.Header().Add("Vary", "Accept")
+	chosen, ok := negotiate(r, v)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, ErrInvalidParameter, fmt.Sprintf("unknown format %q, use %s", r.URL.Query().Get("format"), formatNames(v)))
+		return
+	}
+	chosen.render(w, r, http.StatusOK, title, v)
+}
+
+func renderJSON(w http.ResponseWriter, r *http.Request, status int, title string, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// renderHTML shows v as indented JSON in the branded page, unless it has a
+// page body of its own; error envelopes also get their message as text
+func renderHTML(w http.ResponseWriter, r *http.Request, status int, title string, v any) {
+	var body template.HTML
+	if page, ok := v.(htmlRenderable); ok {
+		body = page.htmlBody()
+	} else {
+		jsonOutput, _ := json.MarshalIndent(v, "", "  ")
+		body = template.HTML("<pre>" + template.HTMLEscapeString(string(jsonOutput)) + "</pre>")
+		if envelope, ok := v.(ErrorEnvelope); ok {
+			body = template.HTML("<p>"+template.HTMLEscapeString(envelope.Error.Message)+"</p>") + body
+		}
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	renderPage(w, title, body)
+}
+
+// responseBuffer holds a rendered response so its size is known before it is sent
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *responseBuffer) Header() http.Header { return b.header }
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// send writes the buffered response to w
+func (b *responseBuffer) send(w http.ResponseWriter) {
+	for name, values := range b.header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
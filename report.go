@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// StatsReport summarises the traffic of one reporting period
+type StatsReport struct {
+	Period        string        `json:"period"`
+	From          time.Time     `json:"from"`
+	To            time.Time     `json:"to"`
+	Requests      int           `json:"requests"`
+	UniqueClients int           `json:"unique_clients"`
+	ClientErrors  int           `json:"client_errors"`
+	ServerErrors  int           `json:"server_errors"`
+	ErrorRate     float64       `json:"error_rate"`
+	Statuses      map[int]int   `json:"statuses"`
+	TopCountries  []ReportCount `json:"top_countries"`
+	TopASNs       []ReportCount `json:"top_asns"`
+}
+
+// ReportCount is one row of a top-N table
+type ReportCount struct {
+	Key      string `json:"key"`
+	Name     string `json:"name"`
+	Requests int    `json:"requests"`
+}
+
+// reportTopN is the number of rows in the top countries and ASNs tables
+var reportTopN = 10
+
+// loadReportTopN reads REPORT_TOP_N, rejecting values below 1
+func loadReportTopN() error {
+	value := getenv("REPORT_TOP_N", "10")
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return fmt.Errorf("REPORT_TOP_N must be a positive integer, not %q", value)
+	}
+	reportTopN = n
+	return nil
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`
+		<p>{{.From.Format "2006-01-02 15:04 MST"}} &ndash; {{.To.Format "2006-01-02 15:04 MST"}}</p>
+		<table>
+			<tr><th>Requests</th><td>{{.Requests}}</td></tr>
+			<tr><th>Unique clients</th><td>{{.UniqueClients}}</td></tr>
+			<tr><th>Client errors (4xx)</th><td>{{.ClientErrors}}</td></tr>
+			<tr><th>Server errors (5xx)</th><td>{{.ServerErrors}}</td></tr>
+			<tr><th>Error rate</th><td>{{printf "%.2f" .ErrorPercent}}%</td></tr>
+		</table>
+		<h2>Top countries</h2>
+		<table>{{range .TopCountries}}
+			<tr><th>{{.Key}}</th><td>{{.Name}}</td><td>{{.Requests}}</td></tr>{{end}}
+		</table>
+		<h2>Top networks</h2>
+		<table>{{range .TopASNs}}
+			<tr><th>{{.Key}}</th><td>{{.Name}}</td><td>{{.Requests}}</td></tr>{{end}}
+		</table>`))
+
+func init() {
+	registerRenderer("csv", "text/csv", implements[StatsReport], renderCSV)
+}
+
+// buildReport resolves the client addresses of snap and ranks countries and
+// ASNs by request count
+func buildReport(period string, snap visitSnapshot) StatsReport {
+	report := StatsReport{
+		Period:        period,
+		From:          snap.from.UTC(),
+		To:            snap.to.UTC(),
+		Requests:      snap.requests,
+		UniqueClients: len(snap.clients),
+		Statuses:      snap.statuses,
+	}
+	for status, n := range snap.statuses {
+		switch {
+		case status >= 500:
+			report.ServerErrors += n
+		case status >= 400:
+			report.ClientErrors += n
+		}
+	}
+	if report.Requests > 0 {
+		report.ErrorRate = float64(report.ClientErrors+report.ServerErrors) / float64(report.Requests)
+	}
+
+	countries := make(map[string]*ReportCount)
+	asns := make(map[string]*ReportCount)
+	count := func(counts map[string]*ReportCount, key, name string, n int) {
+		if counts[key] == nil {
+			counts[key] = &ReportCount{Key: key, Name: name}
+		}
+		counts[key].Requests += n
+	}
+	db := openGeoDatabases(true)
+	defer db.Close()
+	for ip, n := range snap.clients {
+		geo := db.lookup(ip).IPInfo.GeoInfo
+		if geo == nil {
+			count(countries, "unknown", "", n)
+			count(asns, "unknown", "", n)
+			continue
+		}
+		count(countries, cmp.Or(geo.CountryCode, "unknown"), geo.Country, n)
+		if geo.ASN == 0 {
+			count(asns, "unknown", "", n)
+		} else {
+			count(asns, fmt.Sprintf("AS%d", geo.ASN), geo.Organization, n)
+		}
+	}
+	report.TopCountries = topCounts(countries, reportTopN)
+	report.TopASNs = topCounts(asns, reportTopN)
+	return report
+}
+
+// topCounts returns the n largest counts, ties broken by key
+func topCounts(counts map[string]*ReportCount, n int) []ReportCount {
+	rows := make([]ReportCount, 0, len(counts))
+	for _, c := range counts {
+		rows = append(rows, *c)
+	}
+	slices.SortFunc(rows, func(a, b ReportCount) int {
+		return cmp.Or(cmp.Compare(b.Requests, a.Requests), cmp.Compare(a.Key, b.Key))
+	})
+	return rows[:min(n, len(rows))]
+}
+
+// title names the report in pages
+func (report StatsReport) title() string {
+	return fmt.Sprintf("%s report %s", report.Period, report.From.Format("2006-01-02"))
+}
+
+// htmlBody shows the report as tables in the branded page
+func (report StatsReport) htmlBody() template.HTML {
+	var body bytes.Buffer
+	err := reportTemplate.Execute(&body, struct {
+		StatsReport
+		ErrorPercent float64
+	}{report, report.ErrorRate * 100})
+	if err != nil {
+		log.Printf("Could not render report: %v", err)
+	}
+	return template.HTML(body.String())
+}
+
+// writeCSV writes the report as section, key, name and value rows
+func (report StatsReport) writeCSV(out io.Writer) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"section", "key", "name", "value"})
+	w.Write([]string{"summary", "from", "", report.From.Format(time.RFC3339)})
+	w.Write([]string{"summary", "to", "", report.To.Format(time.RFC3339)})
+	w.Write([]string{"summary", "requests", "", strconv.Itoa(report.Requests)})
+	w.Write([]string{"summary", "unique_clients", "", strconv.Itoa(report.UniqueClients)})
+	w.Write([]string{"summary", "client_errors", "", strconv.Itoa(report.ClientErrors)})
+	w.Write([]string{"summary", "server_errors", "", strconv.Itoa(report.ServerErrors)})
+	w.Write([]string{"summary", "error_rate", "", strconv.FormatFloat(report.ErrorRate, 'f', 4, 64)})
+	statuses := make([]int, 0, len(report.Statuses))
+	for status := range report.Statuses {
+		statuses = append(statuses, status)
+	}
+	slices.Sort(statuses)
+	for _, status := range statuses {
+		w.Write([]string{"status", strconv.Itoa(status), http.StatusText(status), strconv.Itoa(report.Statuses[status])})
+	}
+	for _, c := range report.TopCountries {
+		w.Write([]string{"country", c.Key, c.Name, strconv.Itoa(c.Requests)})
+	}
+	for _, c := range report.TopASNs {
+		w.Write([]string{"asn", c.Key, c.Name, strconv.Itoa(c.Requests)})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// renderCSV is the csv renderer for StatsReport
+func renderCSV(w http.ResponseWriter, r *http.Request, status int, title string, v any) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.WriteHeader(status)
+	v.(StatsReport).writeCSV(w)
+}
+
+
+// nextReportTime returns the next UTC midnight, or the next Monday midnight
+// for weekly reports
+func nextReportTime(now time.Time, period string) time.Time {
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	if period == "weekly" {
+		for next.Weekday() != time.Monday {
+			next = next.AddDate(0, 0, 1)
+		}
+	}
+	return next
+}
+
+// startReportScheduler writes a report at the end of every REPORT_SCHEDULE
+// period to REPORT_DIR and/or POSTs it to REPORT_WEBHOOK_URL
+func startReportScheduler() {
+	period := getenv("REPORT_SCHEDULE", "")
+	if period == "" {
+		return
+	}
+	if period != "daily" && period != "weekly" {
+		log.Printf("Reports disabled: REPORT_SCHEDULE must be daily or weekly, not %q", period)
+		return
+	}
+	dir := getenv("REPORT_DIR", "")
+	webhook := getenv("REPORT_WEBHOOK_URL", "")
+	if dir == "" && webhook == "" {
+		log.Printf("Reports disabled: set REPORT_DIR or REPORT_WEBHOOK_URL")
+		return
+	}
+	formats := getenvList("REPORT_FORMATS", "json")
+	for _, format := range formats {
+		if rendererFor(format, StatsReport{}) == nil {
+			log.Printf("Reports disabled: unknown format %q in REPORT_FORMATS", format)
+			return
+		}
+	}
+
+	go func() {
+		for {
+			time.Sleep(time.Until(nextReportTime(time.Now(), period)))
+			report := buildReport(period, visits.snapshot(true))
+			for _, format := range formats {
+				if err := deliverReport(report, format, dir, webhook); err != nil {
+					log.Printf("Could not deliver %s %s report: %v", period, format, err)
+				}
+			}
+		}
+	}()
+}
+
+// deliverReport renders report in format and writes and/or posts it
+func deliverReport(report StatsReport, format, dir, webhook string) error {
+	content, contentType, err := renderFormat(format, report.title(), report)
+	if err != nil {
+		return err
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+		name := fmt.Sprintf("report-%s-%s.%s", report.Period, report.From.Format("2006-01-02"), format)
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0o644); err != nil {
+			return err
+		}
+	}
+	if webhook != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), getenvDuration("REPORT_WEBHOOK_TIMEOUT", 10*time.Second))
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(content))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("webhook answered %s", resp.Status)
+		}
+	}
+	return nil
+}
+
+// reportHandler serves GET /admin/report, a preview of the current period
+// that does not reset the counters
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	report := buildReport(getenv("REPORT_SCHEDULE", "current"), visits.snapshot(false))
+	writeResponse(w, r, report.title(), report)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// SmallReport is the compact connection report used when the response size is capped.
+// Fields are declared in order of importance and dropped from the end to fit.
+type SmallReport struct {
+	IP          string `json:"ip"`
+	Family      string `json:"family,omitempty"`
+	CountryCode string `json:"cc,omitempty"`
+	ASN         uint   `json:"asn,omitempty"`
+	Country     string `json:"country,omitempty"`
+	City        string `json:"city,omitempty"`
+	Org         string `json:"org,omitempty"`
+	ReverseDNS  string `json:"rdns,omitempty"`
+}
+
+// formats keeps the compact report to JSON, the only format whose size is
+// worth capping
+func (SmallReport) formats() []string {
+	return []string{"json"}
+}
+
+func smallHandler(w http.ResponseWriter, r *http.Request) {
+	limit := getenvInt("SMALL_MAX_BYTES", 1200)
+	if r.URL.Query().Has("max-bytes") {
+		n, err := maxBytesParam(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidParameter, err.Error())
+			return
+		}
+		limit = n
+	}
+	writeSmallResponse(w, r, limit)
+}
+
+// maxBytesParam parses the max-bytes query parameter
+func maxBytesParam(r *http.Request) (int, error) {
+	n, err := strconv.Atoi(r.URL.Query().Get("max-bytes"))
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("max-bytes must be a positive integer")
+	}
+	return n, nil
+}
+
+// writeSmallResponse writes the compact report so that the status line,
+// headers and body together do not exceed limit bytes on the wire. When not
+// even the address fits it answers 400 instead.
+func writeSmallResponse(w http.ResponseWriter, r *http.Request, limit int) {
+	ip := clientIP(r)
+	skip := parseSkipOptions(r)
+	full := SmallReport{IP: ip, Family: ipFamily(ip)}
+	if !skip.Geo {
+		if geo := getPublicIPInfo(ip).IPInfo.GeoInfo; geo != nil {
+			full.CountryCode = geo.CountryCode
+			full.ASN = geo.ASN
+			full.Country = geo.Country
+			full.City = geo.City
+			full.Org = geo.Organization
+		}
+	}
+	if !skip.RDNS {
+		// The compact report has no room for warnings, so failures just leave rdns out
+		full.ReverseDNS, _ = reverseDNS(ip)
+	}
+
+	// net/http adds Date, and Connection on connections it closes, unless the
+	// handler set them. Date is suppressed and Connection always set so that
+	// every header line is in the map and counted. Trailers need chunked
+	// encoding, which the fixed Content-Length rules out, so ?transfer-stats
+	// does not declare them here.
+	header := w.Header()
+	header.Del("Trailer")
+	header["Date"] = nil
+	header.Set("Connection", "close")
+
+	size := 0
+	for fields := 8; fields >= 1; fields-- {
+		buf := &responseBuffer{header: header.Clone()}
+		writeResponse(buf, r, "Your Address", truncateSmallReport(full, fields))
+		buf.header.Set("Content-Length", strconv.Itoa(buf.body.Len()))
+		if size = wireSize(buf.status, buf.header, buf.body.Bytes()); size <= limit || buf.status != http.StatusOK {
+			buf.send(w)
+			return
+		}
+	}
+	delete(header, "Date")
+	writeError(w, r, http.StatusBadRequest, ErrInvalidParameter, fmt.Sprintf("the smallest response is %d bytes, more than the limit of %d", size, limit))
+}
+
+// truncateSmallReport keeps only the first n fields of report
+func truncateSmallReport(report SmallReport, n int) SmallReport {
+	kept := SmallReport{IP: report.IP}
+	values := []func(){
+		func() { kept.Family = report.Family },
+		func() { kept.CountryCode = report.CountryCode },
+		func() { kept.ASN = report.ASN },
+		func() { kept.Country = report.Country },
+		func() { kept.City = report.City },
+		func() { kept.Org = report.Org },
+		func() { kept.ReverseDNS = report.ReverseDNS },
+	}
+	for i := 0; i < n-1 && i < len(values); i++ {
+		values[i]()
+	}
+	return kept
+}
+
+// wireSize is the HTTP/1.1 size of a response with the given status, headers
+// and body, as net/http writes it when header holds every header line
+func wireSize(status int, header http.Header, body []byte) int {
+	size := len(fmt.Sprintf("HTTP/1.1 %03d %s\r\n", status, http.StatusText(status))) + len("\r\n") + len(body)
+	for name, values := range header {
+		for _, value := range values {
+			size += len(name) + len(": ") + len(value) + len("\r\n")
+		}
+	}
+	return size
+}
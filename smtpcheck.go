@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MailServerHealth is the response of /check-smtp
+type MailServerHealth struct {
+	IP     string         `json:"ip"`
+	FCrDNS FCrDNSResult   `json:"fcrdns"`
+	Ports  []SMTPPort     `json:"ports"`
+	DNSBL  []DNSBLListing `json:"dnsbl"`
+}
+
+// FCrDNSResult reports whether the PTR name resolves back to the address
+type FCrDNSResult struct {
+	PTR              []string `json:"ptr"`
+	ForwardConfirmed bool     `json:"forward_confirmed"`
+	Error            string   `json:"error,omitempty"`
+}
+
+// SMTPPort is the outcome of connecting back to one SMTP port
+type SMTPPort struct {
+	Port        int    `json:"port"`
+	Open        bool   `json:"open"`
+	Banner      string `json:"banner,omitempty"`
+	ImplicitTLS bool   `json:"implicit_tls"`
+	STARTTLS    bool   `json:"starttls"`
+	TLSVersion  string `json:"tls_version,omitempty"`
+	Duration    string `json:"duration"`
+	Error       string `json:"error,omitempty"`
+}
+
+// DNSBLListing is the result of one blocklist query
+type DNSBLListing struct {
+	Zone   string `json:"zone"`
+	Listed bool   `json:"listed"`
+	Result string `json:"result,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// smtpCheckLimiter allows one check per client address, or IPv6 /64, per
+// SMTP_CHECK_INTERVAL
+var smtpCheckLimiter = newFixedRateLimiter(rateLimit{
+	perSecond: 1 / getenvDuration("SMTP_CHECK_INTERVAL", 10*time.Minute).Seconds(),
+	burst:     1,
+})
+
+// smtpCheckHandler connects back to the caller's mail ports. It is disabled
+// unless SMTP_CHECK_ENABLED is set and only runs on a POST with consent=yes,
+// since it opens connections to the client's address.
+func smtpCheckHandler(w http.ResponseWriter, r *http.Request) {
+	if enabled, _ := strconv.ParseBool(getenv("SMTP_CHECK_ENABLED", "false")); !enabled {
+		writeError(w, r, http.StatusNotImplemented, ErrNotConfigured, "the SMTP check is not enabled on this server")
+		return
+	}
+	if !requireFeature(w, r, "smtp") {
+		return
+	}
+
+	// Only the caller's own address may be checked, so a client supplied
+	// X-Forwarded-For entry must not pick the target
+	ip := trustedClientIP(r)
+	if r.Method != http.MethodPost || r.FormValue("consent") != "yes" {
+		writeResponse(w, r, "Mail Server Check", map[string]string{
+			"target":  ip,
+			"message": "POST to /check-smtp with consent=yes to let this server connect to ports 25, 465 and 587 of the target address",
+		})
+		return
+	}
+
+	if crossSite(r) {
+		writeError(w, r, http.StatusForbidden, ErrCrossSite, "the SMTP check cannot be started from another site")
+		return
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil || !parsed.IsGlobalUnicast() || parsed.IsPrivate() {
+		writeError(w, r, http.StatusBadRequest, ErrInvalidIP, fmt.Sprintf("%s is not a public address", ip))
+		return
+	}
+	if ok, wait := smtpCheckLimiter.allow(rateLimitKey(ip)); !ok {
+		seconds := int(wait.Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		writeError(w, r, http.StatusTooManyRequests, ErrRateLimited, fmt.Sprintf("only one SMTP check per address is allowed, retry in %d seconds", seconds))
+		return
+	}
+
+	writeResponse(w, r, "Mail Server Check", checkMailServer(r.Context(), ip))
+}
+
+// checkMailServer runs the port probes, FCrDNS and DNSBL queries concurrently
+func checkMailServer(ctx context.Context, ip string) MailServerHealth {
+	health := MailServerHealth{IP: ip}
+	ports := []int{25, 465, 587}
+	health.Ports = make([]SMTPPort, len(ports))
+
+	var wg sync.WaitGroup
+	for i, port := range ports {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			health.Ports[i] = probeSMTP(ctx, ip, port)
+		}()
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		health.FCrDNS = forwardConfirmedRDNS(ctx, ip)
+	}()
+	go func() {
+		defer wg.Done()
+		health.DNSBL = queryDNSBLs(ctx, ip)
+	}()
+	wg.Wait()
+	return health
+}
+
+// probeSMTP reads the banner on port and checks for STARTTLS; port 465 uses
+// implicit TLS. Certificates are not verified since only support is reported.
+func probeSMTP(ctx context.Context, ip string, port int) (result SMTPPort) {
+	result = SMTPPort{Port: port, ImplicitTLS: port == 465}
+	start := time.Now()
+	defer func() { result.Duration = time.Since(start).Round(time.Millisecond).String() }()
+
+	ctx, cancel := context.WithTimeout(ctx, getenvDuration("SMTP_CHECK_TIMEOUT", 10*time.Second))
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer conn.Close()
+	result.Open = true
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if result.ImplicitTLS {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			result.Error = fmt.Sprintf("TLS handshake: %v", err)
+			return result
+		}
+		result.TLSVersion = tls.VersionName(tlsConn.ConnectionState().Version)
+		conn = tlsConn
+	}
+
+	text := textproto.NewConn(conn)
+	_, banner, err := text.ReadResponse(220)
+	if err != nil {
+		result.Error = fmt.Sprintf("banner: %v", err)
+		return result
+	}
+	result.Banner = banner
+
+	hostname, _ := os.Hostname()
+	id, err := text.Cmd("EHLO %s", hostname)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	text.StartResponse(id)
+	_, extensions, err := text.ReadResponse(250)
+	text.EndResponse(id)
+	if err != nil {
+		result.Error = fmt.Sprintf("EHLO: %v", err)
+		return result
+	}
+	for _, line := range strings.Split(extensions, "\n") {
+		if strings.EqualFold(strings.TrimSpace(line), "STARTTLS") {
+			result.STARTTLS = true
+		}
+	}
+
+	if result.STARTTLS && !result.ImplicitTLS {
+		id, err := text.Cmd("STARTTLS")
+		if err == nil {
+			text.StartResponse(id)
+			_, _, err = text.ReadResponse(220)
+			text.EndResponse(id)
+		}
+		if err != nil {
+			result.Error = fmt.Sprintf("STARTTLS: %v", err)
+			return result
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			result.Error = fmt.Sprintf("STARTTLS handshake: %v", err)
+			return result
+		}
+		result.TLSVersion = tls.VersionName(tlsConn.ConnectionState().Version)
+		text = textproto.NewConn(tlsConn)
+	}
+	text.Cmd("QUIT")
+	return result
+}
+
+// forwardConfirmedRDNS checks that a PTR name of ip resolves back to ip
+func forwardConfirmedRDNS(ctx context.Context, ip string) FCrDNSResult {
+	result := FCrDNSResult{PTR: []string{}}
+	ctx, cancel := context.WithTimeout(ctx, getenvDuration("RDNS_TIMEOUT", 2*time.Second)*2)
+	defer cancel()
+
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	target := net.ParseIP(ip)
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		result.PTR = append(result.PTR, name)
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		if slices.ContainsFunc(addrs, func(addr net.IPAddr) bool { return addr.IP.Equal(target) }) {
+			result.ForwardConfirmed = true
+		}
+	}
+	return result
+}
+
+// queryDNSBLs looks ip up in each zone of SMTP_DNSBL_ZONES
+func queryDNSBLs(ctx context.Context, ip string) []DNSBLListing {
+	zones := getenvList("SMTP_DNSBL_ZONES", "zen.spamhaus.org,bl.spamcop.net,b.barracudacentral.org")
+	listings := make([]DNSBLListing, len(zones))
+	reversed := reverseIPLabels(net.ParseIP(ip))
+
+	ctx, cancel := context.WithTimeout(ctx, getenvDuration("LOOKUP_TIMEOUT", 5*time.Second))
+	defer cancel()
+	var wg sync.WaitGroup
+	for i, zone := range zones {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			listing := DNSBLListing{Zone: zone}
+			query := reversed + "." + zone
+			if addrs, err := net.DefaultResolver.LookupHost(ctx, query); err == nil && len(addrs) > 0 {
+				listing.Listed = true
+				listing.Result = strings.Join(addrs, ", ")
+				if txts, err := net.DefaultResolver.LookupTXT(ctx, query); err == nil {
+					listing.Reason = strings.Join(txts, " ")
+				}
+			}
+			listings[i] = listing
+		}()
+	}
+	wg.Wait()
+	return listings
+}
+
+// reverseIPLabels returns the DNSBL query labels of ip: reversed octets for
+// IPv4 and reversed nibbles for IPv6
+func reverseIPLabels(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", v4[3], v4[2], v4[1], v4[0])
+	}
+	const hexDigits = "0123456789abcdef"
+	labels := make([]string, 0, 32)
+	for i := len(ip) - 1; i >= 0; i-- {
+		labels = append(labels, string(hexDigits[ip[i]&0x0f]), string(hexDigits[ip[i]>>4]))
+	}
+	return strings.Join(labels, ".")
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+//go:embed static
+var staticFiles embed.FS
+
+// startTime is used as Last-Modified for embedded assets, which can only change
+// when a new binary is started
+var startTime = time.Now()
+
+// noStore marks every response as uncacheable unless the handler sets its own
+// Cache-Control; connection reports are specific to a single request
+func noStore(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// staticHandler serves the embedded scripts and stylesheets under /static/
+// with an ETag and Last-Modified so browsers can revalidate with a 304
+func staticHandler() http.Handler {
+	sub, _ := fs.Sub(staticFiles, "static")
+	return http.StripPrefix("/static/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean(strings.TrimPrefix(r.URL.Path, "/"))
+		content, err := fs.ReadFile(sub, name)
+		if err != nil {
+			writeError(w, r, http.StatusNotFound, ErrNotFound, fmt.Sprintf("no static asset %s", name))
+			return
+		}
+		serveCacheable(w, r, name, content)
+	}))
+}
+
+// serveCacheable writes a stable resource with validators, answering
+// conditional requests with 304 Not Modified
+func serveCacheable(w http.ResponseWriter, r *http.Request, name string, content []byte) {
+	sum := sha256.Sum256(content)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Cache-Control", "public, no-cache")
+	http.ServeContent(w, r, name, startTime, bytes.NewReader(content))
+}
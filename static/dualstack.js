@@ -0,0 +1,63 @@
+(function () {
+  var table = document.getElementById("dualstack");
+  var pageFamily = table.dataset.pageFamily;
+
+  // probe fetches a single-family endpoint and resolves with its report and
+  // the round trip time, or null when the family is unreachable
+  function probe(url, family) {
+    var start = performance.now();
+    return fetch(url, { cache: "no-store", headers: { Accept: "application/json" } }).then(function (response) {
+      if (!response.ok) {
+        throw new Error("HTTP " + response.status);
+      }
+      return response.json();
+    }).then(function (report) {
+      var elapsed = performance.now() - start;
+      if (report.family !== family) {
+        show(family, "not reachable (answered over " + report.family + ")");
+        return null;
+      }
+      show(family, report.ip);
+      show(family + "-latency", elapsed.toFixed(0) + " ms");
+      return { ip: report.ip, latency: elapsed };
+    }).catch(function () {
+      show(family, "not reachable");
+      return null;
+    });
+  }
+
+  function show(id, text) {
+    document.getElementById(id).textContent = text;
+  }
+
+  function diagnose(v4, v6) {
+    if (!v4 && !v6) {
+      return "Neither single-family endpoint answered; the test hostnames may be blocked or misconfigured.";
+    }
+    if (!v6) {
+      return "IPv4 only: this connection has no working IPv6.";
+    }
+    if (!v4) {
+      return "IPv6 only: this connection has no working IPv4 (possibly NAT64/DNS64).";
+    }
+
+    var delta = v6.latency - v4.latency;
+    show("delta", (delta > 0 ? "+" : "") + delta.toFixed(0) + " ms");
+    if (pageFamily === "ipv6") {
+      return "Dual-stack: the browser preferred IPv6 for this page" +
+        (delta > 0 ? " even though it was " + delta.toFixed(0) + " ms slower, as Happy Eyeballs intends." : ", which was also the faster family.");
+    }
+    if (pageFamily === "ipv4") {
+      return "Dual-stack, but the browser chose IPv4 for this page" +
+        (delta > 0 ? ": IPv6 was " + delta.toFixed(0) + " ms slower, so Happy Eyeballs likely fell back to IPv4." : " although IPv6 was not slower; the browser or OS may be configured to prefer IPv4.");
+    }
+    return "Dual-stack connection.";
+  }
+
+  Promise.all([
+    probe(table.dataset.ipv4Url, "ipv4"),
+    probe(table.dataset.ipv6Url, "ipv6")
+  ]).then(function (results) {
+    show("diagnosis", diagnose(results[0], results[1]));
+  });
+})();
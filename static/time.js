@@ -0,0 +1,72 @@
+(function () {
+  var rounds = 8;
+
+  // now is the local wall clock in milliseconds with sub-millisecond precision
+  function now() {
+    return performance.timeOrigin + performance.now();
+  }
+
+  function show(id, text) {
+    document.getElementById(id).textContent = text;
+  }
+
+  // sample does one round trip and returns the NTP style offset and delay:
+  // offset = ((t1 - t0) + (t2 - t3)) / 2, delay = (t3 - t0) - (t2 - t1)
+  function sample() {
+    var t0 = now();
+    return fetch("/time", { cache: "no-store", headers: { Accept: "application/json" } }).then(function (response) {
+      if (!response.ok) {
+        throw new Error("HTTP " + response.status);
+      }
+      return response.json();
+    }).then(function (report) {
+      var t3 = now();
+      var t1 = report.received_unix_nanos / 1e6;
+      var t2 = report.sent_unix_nanos / 1e6;
+      return { offset: ((t1 - t0) + (t2 - t3)) / 2, delay: (t3 - t0) - (t2 - t1) };
+    });
+  }
+
+  function formatOffset(ms) {
+    var abs = Math.abs(ms);
+    var text = abs >= 1000 ? (abs / 1000).toFixed(3) + " s" : abs.toFixed(1) + " ms";
+    return text + (ms > 0 ? " behind" : " ahead of") + " the server";
+  }
+
+  function verdict(offset) {
+    var abs = Math.abs(offset);
+    if (abs > 5 * 60 * 1000) {
+      return "Your clock is off by more than five minutes. This breaks TLS certificate validation, one-time passcodes and signed URLs; enable automatic time synchronization.";
+    }
+    if (abs > 2000) {
+      return "Your clock is noticeably off. Most sites still work, but check that automatic time synchronization is enabled.";
+    }
+    return "Your clock is in sync with the server.";
+  }
+
+  // The samples run one after another; the one with the shortest delay has
+  // the least asymmetric path and gives the best offset estimate
+  var samples = [];
+  function next() {
+    if (samples.length === rounds) {
+      return Promise.resolve();
+    }
+    return sample().then(function (s) {
+      samples.push(s);
+      show("samples", samples.length + " of " + rounds);
+      return next();
+    });
+  }
+
+  next().then(function () {
+    var best = samples.reduce(function (a, b) { return b.delay < a.delay ? b : a; });
+    var serverNow = now() + best.offset;
+    show("server-time", new Date(serverNow).toISOString());
+    show("client-time", new Date(now()).toISOString());
+    show("offset", best.offset === 0 ? "none" : formatOffset(best.offset) + " (±" + (best.delay / 2).toFixed(1) + " ms)");
+    show("rtt", best.delay.toFixed(1) + " ms");
+    document.getElementById("verdict").textContent = verdict(best.offset);
+  }).catch(function (err) {
+    show("server-time", "measurement failed: " + err.message);
+  });
+})();
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxTrackedClients bounds the per-address counts kept between reports;
+// requests from further addresses are still counted in the totals
+const maxTrackedClients = 100000
+
+// visitStats counts requests by status and client address for the periodic
+// reports. Addresses are only resolved to countries and ASNs when a report is
+// rendered, keeping the request path free of extra lookups.
+type visitStats struct {
+	mu       sync.Mutex
+	since    time.Time
+	requests int
+	statuses map[int]int
+	clients  map[string]int
+}
+
+var visits = newVisitStats()
+
+func newVisitStats() *visitStats {
+	return &visitStats{since: time.Now(), statuses: make(map[int]int), clients: make(map[string]int)}
+}
+
+// record counts a finished request
+func (v *visitStats) record(ip string, status int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.requests++
+	v.statuses[status]++
+	if _, ok := v.clients[ip]; ok || len(v.clients) < maxTrackedClients {
+		v.clients[ip]++
+	}
+}
+
+// visitSnapshot is a copy of the counters for one reporting period
+type visitSnapshot struct {
+	from, to time.Time
+	requests int
+	statuses map[int]int
+	clients  map[string]int
+}
+
+// snapshot copies the counters, starting a new period when reset is set
+func (v *visitStats) snapshot(reset bool) visitSnapshot {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	snap := visitSnapshot{from: v.since, to: time.Now(), requests: v.requests, statuses: v.statuses, clients: v.clients}
+	if reset {
+		v.since, v.requests = snap.to, 0
+		v.statuses, v.clients = make(map[int]int), make(map[string]int)
+		return snap
+	}
+	snap.statuses = make(map[int]int, len(v.statuses))
+	for status, n := range v.statuses {
+		snap.statuses[status] = n
+	}
+	snap.clients = make(map[string]int, len(v.clients))
+	for ip, n := range v.clients {
+		snap.clients[ip] = n
+	}
+	return snap
+}
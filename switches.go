@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// switchableFeatures are the expensive subsystems operators can turn off at runtime
+var switchableFeatures = []string{"egress", "lookup", "geo", "rdns", "weather", "smtp", "probe"}
+
+// SwitchState is the runtime state of maintenance mode and the kill switches,
+// as exchanged with the admin API
+type SwitchState struct {
+	Maintenance       bool     `json:"maintenance"`
+	RetryAfterSeconds int      `json:"retry_after_seconds"`
+	DisabledFeatures  []string `json:"disabled_features"`
+}
+
+// featureSwitches guards the current SwitchState
+type featureSwitches struct {
+	mu    sync.RWMutex
+	state SwitchState
+}
+
+// switches starts from MAINTENANCE_MODE, MAINTENANCE_RETRY_AFTER and
+// DISABLED_FEATURES and can be changed through /admin/switches
+var switches = loadSwitches()
+
+func loadSwitches() *featureSwitches {
+	maintenance, _ := strconv.ParseBool(getenv("MAINTENANCE_MODE", "false"))
+	retryAfter, err := strconv.Atoi(getenv("MAINTENANCE_RETRY_AFTER", "300"))
+	if err != nil || retryAfter < 0 {
+		retryAfter = 300
+	}
+	state := SwitchState{
+		Maintenance:       maintenance,
+		RetryAfterSeconds: retryAfter,
+		DisabledFeatures:  getenvList("DISABLED_FEATURES", ""),
+	}
+	if err := state.validate(); err != nil {
+		log.Printf("Ignoring DISABLED_FEATURES: %v", err)
+		state.DisabledFeatures = nil
+	}
+	if state.DisabledFeatures == nil {
+		state.DisabledFeatures = []string{}
+	}
+	return &featureSwitches{state: state}
+}
+
+// validate rejects unknown feature names and negative retry delays
+func (s SwitchState) validate() error {
+	for _, feature := range s.DisabledFeatures {
+		if !slices.Contains(switchableFeatures, feature) {
+			return fmt.Errorf("unknown feature %q, expected one of %s", feature, strings.Join(switchableFeatures, ", "))
+		}
+	}
+	if s.RetryAfterSeconds < 0 {
+		return fmt.Errorf("retry_after_seconds must not be negative")
+	}
+	return nil
+}
+
+// enabled reports whether feature has not been switched off
+func (f *featureSwitches) enabled(feature string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return !slices.Contains(f.state.DisabledFeatures, feature)
+}
+
+// get returns a copy of the current state
+func (f *featureSwitches) get() SwitchState {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	state := f.state
+	state.DisabledFeatures = slices.Clone(f.state.DisabledFeatures)
+	return state
+}
+
+// update lets change edit a copy of the current state and stores it, returning
+// the previous and the new state. The lock is held meanwhile so concurrent
+// updates neither lose each other's fields nor audit a stale previous state;
+// when change fails nothing changes.
+func (f *featureSwitches) update(change func(previous SwitchState, next *SwitchState) error) (SwitchState, SwitchState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	previous := f.state
+	next := previous
+	next.DisabledFeatures = slices.Clone(previous.DisabledFeatures)
+	if err := change(previous, &next); err != nil {
+		return previous, previous, err
+	}
+	f.state = next
+	return previous, next, nil
+}
+
+// requireFeature writes a 503 and returns false when feature is switched off
+func requireFeature(w http.ResponseWriter, r *http.Request, feature string) bool {
+	if switches.enabled(feature) {
+		return true
+	}
+	writeError(w, r, http.StatusServiceUnavailable, ErrFeatureDisabled, fmt.Sprintf("%s is temporarily disabled by the operator", feature))
+	return false
+}
+
+// withMaintenance answers every non-admin request with 503 while maintenance mode is on
+func withMaintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := switches.get()
+		if state.Maintenance && !strings.HasPrefix(r.URL.Path, "/admin/") {
+			w.Header().Set("Retry-After", strconv.Itoa(state.RetryAfterSeconds))
+			writeError(w, r, http.StatusServiceUnavailable, ErrMaintenance, "the service is down for maintenance")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminTokens maps bearer tokens to actor names. ADMIN_TOKEN is the token of
+// the "admin" actor and ADMIN_TOKENS adds named ones as name:token pairs.
+func adminTokens() map[string]string {
+	tokens := make(map[string]string)
+	if token := getenv("ADMIN_TOKEN", ""); token != "" {
+		tokens[token] = "admin"
+	}
+	for _, pair := range getenvList("ADMIN_TOKENS", "") {
+		if name, token, ok := strings.Cut(pair, ":"); ok && name != "" && token != "" {
+			tokens[token] = name
+		}
+	}
+	return tokens
+}
+
+// requireAdmin checks the bearer token and returns the actor it belongs to;
+// the admin API is disabled when no token is configured
+func requireAdmin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	tokens := adminTokens()
+	if len(tokens) == 0 {
+		writeError(w, r, http.StatusNotFound, ErrNotConfigured, "the admin API is not configured")
+		return "", false
+	}
+	if given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		for token, actor := range tokens {
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+				return actor, true
+			}
+		}
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeError(w, r, http.StatusUnauthorized, ErrUnauthorized, "a valid admin token is required")
+	return "", false
+}
+
+// switchesHandler serves GET and PUT /admin/switches. A PUT body only changes
+// the fields it contains.
+func switchesHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidParameter, fmt.Sprintf("invalid switch state: %v", err))
+			return
+		}
+		var invalid error
+		previous, state, err := switches.update(func(previous SwitchState, state *SwitchState) error {
+			decoder := json.NewDecoder(bytes.NewReader(body))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(state); err != nil {
+				invalid = fmt.Errorf("invalid switch state: %v", err)
+				return invalid
+			}
+			if err := state.validate(); err != nil {
+				invalid = err
+				return invalid
+			}
+			if state.DisabledFeatures == nil {
+				state.DisabledFeatures = []string{}
+			}
+			return audit.record(r, actor, "switches.updated", previous, *state)
+		})
+		if invalid != nil {
+			writeError(w, r, http.StatusBadRequest, ErrInvalidParameter, invalid.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("Could not write audit log, switches left unchanged: %v", err)
+			writeError(w, r, http.StatusInternalServerError, ErrInternal, "the change could not be written to the audit log and was not applied")
+			return
+		}
+		log.Printf("Switches changed by %s from %+v to %+v", actor, previous, state)
+	}
+
+	writeResponse(w, r, "Switches", switches.get())
+}
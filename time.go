@@ -0,0 +1,49 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// TimeReport is the server clock reading served by /time. ReceivedUnixNanos
+// and SentUnixNanos let a client estimate its offset the way NTP does.
+type TimeReport struct {
+	Time              string `json:"time"`
+	ReceivedUnixNanos int64  `json:"received_unix_nanos"`
+	SentUnixNanos     int64  `json:"sent_unix_nanos"`
+}
+
+const timePage = `
+		<table id="clock">
+			<tr><th>Server time</th><td id="server-time">measuring&hellip;</td></tr>
+			<tr><th>Your clock</th><td id="client-time">&ndash;</td></tr>
+			<tr><th>Offset</th><td id="offset">&ndash;</td></tr>
+			<tr><th>Best round trip</th><td id="rtt">&ndash;</td></tr>
+			<tr><th>Samples</th><td id="samples">&ndash;</td></tr>
+		</table>
+		<p id="verdict"></p>
+		<script src="/static/time.js"></script>`
+
+// defaultFormat keeps JSON for API clients; browsers ask for text/html and
+// get the clock check page
+func (TimeReport) defaultFormat() string {
+	return "json"
+}
+
+// htmlBody is the page that measures the local clock offset over several
+// round trips; its script fetches the JSON report itself
+func (TimeReport) htmlBody() template.HTML {
+	return template.HTML(timePage)
+}
+
+// timeHandler serves the server time, or to browsers the clock check page
+func timeHandler(w http.ResponseWriter, r *http.Request) {
+	received := time.Now()
+	sent := time.Now()
+	writeResponse(w, r, "Clock Check", TimeReport{
+		Time:              sent.UTC().Format(time.RFC3339Nano),
+		ReceivedUnixNanos: received.UnixNano(),
+		SentUnixNanos:     sent.UnixNano(),
+	})
+}
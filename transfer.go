@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TransferStats is what the server measured while writing one response.
+// HeaderBytesEstimate counts the status line and the headers set by the
+// handlers; net/http adds Date, Content-Length or Transfer-Encoding, and
+// Connection afterwards, which are not seen here.
+type TransferStats struct {
+	TransferID          string `json:"transfer_id"`
+	RequestID           string `json:"request_id"`
+	Path                string `json:"path"`
+	Status              int    `json:"status"`
+	HeaderBytesEstimate int    `json:"header_bytes_estimate"`
+	BodyBytes           int64  `json:"body_bytes"`
+	BodySHA256          string `json:"body_sha256"`
+	TTFB                string `json:"ttfb"`
+	Duration            string `json:"duration"`
+
+	owner    string
+	recorded time.Time
+}
+
+// transferWriter counts and hashes the body and notes when the first byte is written
+type transferWriter struct {
+	http.ResponseWriter
+	start     time.Time
+	firstByte time.Time
+	status    int
+	header    int
+	bytes     int64
+	digest    hash.Hash
+}
+
+func (t *transferWriter) WriteHeader(status int) {
+	if t.status == 0 {
+		t.status = status
+		t.firstByte = time.Now()
+		t.header = wireSize(status, t.Header(), nil)
+	}
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *transferWriter) Write(b []byte) (int, error) {
+	if t.status == 0 {
+		t.WriteHeader(http.StatusOK)
+	}
+	n, err := t.ResponseWriter.Write(b)
+	t.bytes += int64(n)
+	t.digest.Write(b[:n])
+	return n, err
+}
+
+func (t *transferWriter) Flush() {
+	if f, ok := t.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (t *transferWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// transferTrailers are sent after the body when the client accepts trailers
+var transferTrailers = []string{"X-Response-Bytes", "X-Response-SHA256", "X-Server-TTFB"}
+
+// transferIDHeader carries the ID under which the stats of a response can be
+// fetched. It is generated by the server, unlike X-Request-ID, which the
+// client may choose.
+const transferIDHeader = "X-Transfer-ID"
+
+// transferStore keeps recent stats for the /transfer/{id} follow-up request
+type transferStore struct {
+	mu      sync.Mutex
+	entries map[string]TransferStats
+	order   []string
+}
+
+const (
+	transferStoreSize = 1000
+	transferStoreTTL  = 5 * time.Minute
+)
+
+var transfers = &transferStore{entries: make(map[string]TransferStats)}
+
+func (s *transferStore) add(stats TransferStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.order = append(s.order, stats.TransferID)
+	s.entries[stats.TransferID] = stats
+	for len(s.order) > transferStoreSize {
+		delete(s.entries, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+func (s *transferStore) get(id string) (TransferStats, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats, ok := s.entries[id]
+	if !ok || time.Since(stats.recorded) > transferStoreTTL {
+		return TransferStats{}, false
+	}
+	return stats, true
+}
+
+// withTransferStats measures every response. Clients sending "TE: trailers"
+// or ?transfer-stats get the totals as HTTP trailers; all others can fetch
+// them afterwards from /transfer/{transfer id}.
+func withTransferStats(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/transfer/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id := make([]byte, 16)
+		rand.Read(id)
+		transferID := hex.EncodeToString(id)
+		w.Header().Set(transferIDHeader, transferID)
+
+		trailers := r.URL.Query().Has("transfer-stats") || strings.Contains(strings.ToLower(r.Header.Get("TE")), "trailers")
+		if trailers {
+			w.Header().Set("Trailer", strings.Join(transferTrailers, ", "))
+		}
+
+		tw := &transferWriter{ResponseWriter: w, start: time.Now(), digest: sha256.New()}
+		next.ServeHTTP(tw, r)
+		if tw.status == 0 {
+			tw.WriteHeader(http.StatusOK)
+		}
+
+		stats := TransferStats{
+			TransferID:          transferID,
+			RequestID:           requestID(r),
+			Path:                r.URL.Path,
+			Status:              tw.status,
+			HeaderBytesEstimate: tw.header,
+			BodyBytes:           tw.bytes,
+			BodySHA256:          hex.EncodeToString(tw.digest.Sum(nil)),
+			TTFB:                tw.firstByte.Sub(tw.start).String(),
+			Duration:            time.Since(tw.start).String(),
+			owner:               trustedClientIP(r),
+			recorded:            time.Now(),
+		}
+		if trailers {
+			w.Header().Set("X-Response-Bytes", strconv.FormatInt(stats.BodyBytes, 10))
+			w.Header().Set("X-Response-SHA256", stats.BodySHA256)
+			w.Header().Set("X-Server-TTFB", stats.TTFB)
+		}
+		transfers.add(stats)
+		if !monitors.exemptFromStats(r) {
+			visits.record(stats.owner, stats.Status)
+		}
+	})
+}
+
+// transferHandler serves GET /transfer/{id} to the client that made the
+// request, identified by its peer address or trusted proxy hop
+func transferHandler(w http.ResponseWriter, r *http.Request) {
+	stats, ok := transfers.get(r.PathValue("id"))
+	if !ok || stats.owner != trustedClientIP(r) {
+		writeError(w, r, http.StatusNotFound, ErrNotFound, "no recent response with that transfer ID to this client")
+		return
+	}
+	writeResponse(w, r, "Transfer Stats", stats)
+}
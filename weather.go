@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WeatherInfo is the current weather and daylight at the client's resolved location
+type WeatherInfo struct {
+	Provider    string   `json:"provider,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Temperature *float64 `json:"temperature_c,omitempty"`
+	FeelsLike   *float64 `json:"feels_like_c,omitempty"`
+	Humidity    *int     `json:"humidity_percent,omitempty"`
+	WindSpeed   *float64 `json:"wind_speed_ms,omitempty"`
+	Sunrise     string   `json:"sunrise,omitempty"`
+	Sunset      string   `json:"sunset,omitempty"`
+	DayLength   string   `json:"day_length,omitempty"`
+	Daylight    string   `json:"daylight"`
+}
+
+// weatherCacheEntry holds a provider response for a coarse grid cell
+type weatherCacheEntry struct {
+	info    WeatherInfo
+	fetched time.Time
+}
+
+var (
+	weatherCacheMu    sync.Mutex
+	weatherCache      = make(map[string]weatherCacheEntry)
+	weatherCacheSwept time.Time
+)
+
+const weatherCacheTTL = 10 * time.Minute
+
+// weatherEnabled reports whether the WEATHER_ENABLED feature flag is set
+func weatherEnabled() bool {
+	enabled, _ := strconv.ParseBool(getenv("WEATHER_ENABLED", "false"))
+	return enabled
+}
+
+// getWeather computes daylight for geo and, when WEATHER_API_KEY is set, adds
+// the current conditions from OpenWeatherMap
+func getWeather(ctx context.Context, geo *GeoInfo) (*WeatherInfo, error) {
+	info := &WeatherInfo{}
+	var loc *time.Location
+	if geo.TimeZone != "" {
+		loc, _ = time.LoadLocation(geo.TimeZone)
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	sunrise, sunset, daylight := sunTimes(time.Now(), geo.Latitude, geo.Longitude)
+	info.Daylight = daylight
+	if daylight == "normal" {
+		info.Sunrise = sunrise.In(loc).Format(time.RFC3339)
+		info.Sunset = sunset.In(loc).Format(time.RFC3339)
+		info.DayLength = sunset.Sub(sunrise).Round(time.Minute).String()
+	}
+
+	key := getenv("WEATHER_API_KEY", "")
+	if key == "" {
+		return info, nil
+	}
+	current, err := fetchWeather(ctx, key, geo.Latitude, geo.Longitude)
+	if err != nil {
+		return info, err
+	}
+	current.Sunrise, current.Sunset, current.DayLength, current.Daylight = info.Sunrise, info.Sunset, info.DayLength, info.Daylight
+	return &current, nil
+}
+
+// fetchWeather queries the OpenWeatherMap current weather API, caching results
+// per 0.1 degree cell to stay within provider quotas
+func fetchWeather(ctx context.Context, key string, lat, lon float64) (WeatherInfo, error) {
+	cell := fmt.Sprintf("%.1f,%.1f", lat, lon)
+	weatherCacheMu.Lock()
+	entry, ok := weatherCache[cell]
+	weatherCacheMu.Unlock()
+	if ok && time.Since(entry.fetched) < weatherCacheTTL {
+		return entry.info, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, getenvDuration("WEATHER_TIMEOUT", 3*time.Second))
+	defer cancel()
+	query := url.Values{
+		"lat":   {strconv.FormatFloat(lat, 'f', 4, 64)},
+		"lon":   {strconv.FormatFloat(lon, 'f', 4, 64)},
+		"units": {"metric"},
+		"appid": {key},
+	}
+	endpoint := getenv("WEATHER_API_URL", "https://api.openweathermap.org/data/2.5/weather")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return WeatherInfo{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// Do not leak the API key embedded in the URL
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return WeatherInfo{}, fmt.Errorf("weather provider unreachable: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return WeatherInfo{}, fmt.Errorf("weather provider returned %s", resp.Status)
+	}
+
+	var body struct {
+		Weather []struct {
+			Description string `json:"description"`
+		} `json:"weather"`
+		Main struct {
+			Temp      float64 `json:"temp"`
+			FeelsLike float64 `json:"feels_like"`
+			Humidity  int     `json:"humidity"`
+		} `json:"main"`
+		Wind struct {
+			Speed float64 `json:"speed"`
+		} `json:"wind"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return WeatherInfo{}, fmt.Errorf("invalid weather provider response: %v", err)
+	}
+
+	info := WeatherInfo{
+		Provider:    "openweathermap",
+		Temperature: &body.Main.Temp,
+		FeelsLike:   &body.Main.FeelsLike,
+		Humidity:    &body.Main.Humidity,
+		WindSpeed:   &body.Wind.Speed,
+	}
+	if len(body.Weather) > 0 {
+		info.Description = body.Weather[0].Description
+	}
+
+	weatherCacheMu.Lock()
+	sweepWeatherCache()
+	weatherCache[cell] = weatherCacheEntry{info: info, fetched: time.Now()}
+	weatherCacheMu.Unlock()
+	return info, nil
+}
+
+// sweepWeatherCache drops expired cells at most once per TTL, so the cache only
+// holds the cells looked up recently; the caller holds weatherCacheMu
+func sweepWeatherCache() {
+	if time.Since(weatherCacheSwept) < weatherCacheTTL {
+		return
+	}
+	weatherCacheSwept = time.Now()
+	for cell, entry := range weatherCache {
+		if time.Since(entry.fetched) >= weatherCacheTTL {
+			delete(weatherCache, cell)
+		}
+	}
+}
+
+// sunTimes returns the sunrise and sunset of the solar day nearest to now at
+// the given coordinates, using the sunrise equation with atmospheric
+// refraction. daylight is "polar-day" or "polar-night" when the sun does not
+// cross the horizon, in which case the times are zero.
+func sunTimes(now time.Time, lat, lon float64) (time.Time, time.Time, string) {
+	const (
+		j2000     = 2451545.0
+		unixEpoch = 2440587.5
+		j0        = 0.0009
+	)
+	rad := math.Pi / 180
+
+	days := float64(now.Unix())/86400 + unixEpoch - j2000
+	lw := -lon
+	n := math.Round(days - j0 - lw/360)
+	approxTransit := j0 + lw/360 + n
+
+	meanAnomaly := (357.5291 + 0.98560028*approxTransit) * rad
+	center := (1.9148*math.Sin(meanAnomaly) + 0.02*math.Sin(2*meanAnomaly) + 0.0003*math.Sin(3*meanAnomaly)) * rad
+	eclipticLongitude := meanAnomaly + center + 102.9372*rad + math.Pi
+	declination := math.Asin(math.Sin(23.4397*rad) * math.Sin(eclipticLongitude))
+	transit := j2000 + approxTransit + 0.0053*math.Sin(meanAnomaly) - 0.0069*math.Sin(2*eclipticLongitude)
+
+	cosHourAngle := (math.Sin(-0.833*rad) - math.Sin(lat*rad)*math.Sin(declination)) / (math.Cos(lat*rad) * math.Cos(declination))
+	switch {
+	case cosHourAngle < -1:
+		return time.Time{}, time.Time{}, "polar-day"
+	case cosHourAngle > 1:
+		return time.Time{}, time.Time{}, "polar-night"
+	}
+	halfDay := math.Acos(cosHourAngle) / rad / 360
+
+	toTime := func(julian float64) time.Time {
+		return time.Unix(int64(math.Round((julian-unixEpoch)*86400)), 0).UTC()
+	}
+	return toTime(transit - halfDay), toTime(transit + halfDay), "normal"
+}